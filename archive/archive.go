@@ -0,0 +1,115 @@
+// Package archive looks up archived copies of images whose original host is dead.
+package archive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Capture is a single archived copy of a resource.
+type Capture struct {
+	URL			string
+	Timestamp	time.Time
+}
+
+// Lookup finds the most recent capture of link.
+type Lookup interface {
+	Find(link string) (Capture, error)
+}
+
+var ErrNotFound = errors.New("No archived copy")
+
+const TIMESTAMP_LAYOUT = "20060102150405"
+
+// rawURL points to the archived bytes themselves rather than to the Wayback page around them.
+func rawURL(timestamp, original string) string {
+	return fmt.Sprintf("https://web.archive.org/web/%sid_/%s", timestamp, original)
+}
+
+func getJSON(link string, v interface{}) error {
+	resp, err := http.Get(link)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Unknown error : " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Wayback uses the Wayback Machine availability API.
+type Wayback struct {
+	Endpoint string
+}
+
+func (w Wayback) Find(link string) (Capture, error) {
+	var endpoint string = w.Endpoint
+	if endpoint == "" {
+		endpoint = "https://archive.org/wayback/available"
+	}
+	var result struct {
+		Snapshots struct {
+			Closest struct {
+				Available	bool	`json:"available"`
+				Timestamp	string	`json:"timestamp"`
+				Status		string	`json:"status"`
+			}	`json:"closest"`
+		}	`json:"archived_snapshots"`
+	}
+	err := getJSON(endpoint + "?url=" + url.QueryEscape(link), &result)
+	if err != nil {
+		return Capture{}, err
+	}
+	closest := result.Snapshots.Closest
+	if !closest.Available || (closest.Status != "200") {
+		return Capture{}, ErrNotFound
+	}
+	timestamp, err := time.Parse(TIMESTAMP_LAYOUT, closest.Timestamp)
+	if err != nil {
+		return Capture{}, err
+	}
+	return Capture{URL: rawURL(closest.Timestamp, link), Timestamp: timestamp}, nil
+}
+
+// CDX uses a CDX server, such as the one of the Wayback Machine.
+type CDX struct {
+	Endpoint string
+}
+
+func (c CDX) Find(link string) (Capture, error) {
+	var endpoint string = c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://web.archive.org/cdx/search/cdx"
+	}
+	const QUERY = "?url=%s&output=json&fl=timestamp,original&filter=statuscode:200&filter=mimetype:image/.*&limit=-1"
+	var rows [][]string
+	err := getJSON(endpoint + fmt.Sprintf(QUERY, url.QueryEscape(link)), &rows)
+	if err != nil {
+		return Capture{}, err
+	}
+	// the first row is the header
+	if len(rows) < 2 || len(rows[len(rows)-1]) < 2 {
+		return Capture{}, ErrNotFound
+	}
+	row := rows[len(rows)-1]
+	timestamp, err := time.Parse(TIMESTAMP_LAYOUT, row[0])
+	if err != nil {
+		return Capture{}, err
+	}
+	return Capture{URL: rawURL(row[0], row[1]), Timestamp: timestamp}, nil
+}
+
+// New returns lookup by its name from config, nil if archives are disabled.
+func New(name, endpoint string) (Lookup, error) {
+	switch name {
+		case "": return nil, nil
+		case "wayback": return Wayback{Endpoint: endpoint}, nil
+		case "cdx": return CDX{Endpoint: endpoint}, nil
+	}
+	return nil, fmt.Errorf("Unknown archive %q", name)
+}
@@ -0,0 +1,12 @@
+package archive
+
+// Fake is a local stand-in for an archive, for tests. It knows captures of a fixed set of links.
+type Fake map[string]Capture
+
+func (f Fake) Find(link string) (Capture, error) {
+	capture, ok := f[link]
+	if !ok {
+		return Capture{}, ErrNotFound
+	}
+	return capture, nil
+}
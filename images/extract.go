@@ -0,0 +1,202 @@
+package images
+
+import (
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Kinds of places in markup where image references are found.
+const (
+	KindSrc = "src"
+	KindSrcset = "srcset"
+	KindLink = "link"
+	KindCSS = "css"
+)
+
+// Reference is a single image URL found in post content. URL is absolute and decoded,
+// Raw is how it is written in markup.
+type Reference struct {
+	URL, Raw, Kind string
+	// Thumbnail is set for links to full-size images wrapping an <img>, it is the source of that <img>.
+	Thumbnail string
+}
+
+var tagPattern = regexp.MustCompile(`(?s)<(/?)([a-zA-Z]+)((?:[^>"']|"[^"]*"|'[^']*')*)>`)
+var attributePattern = regexp.MustCompile(`([a-zA-Z-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+var cssURLPattern = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^)\s]*))\s*\)`)
+
+var imageExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".bmp", ".webp", ".tif", ".tiff"}
+
+func attributes(text string) map[string]string {
+	var result map[string]string = make(map[string]string)
+	for _, match := range attributePattern.FindAllStringSubmatch(text, -1) {
+		result[strings.ToLower(match[1])] = match[2] + match[3] + match[4]
+	}
+	return result
+}
+
+func looksLikeImage(link string) bool {
+	link = strings.SplitN(strings.SplitN(link, "#", 2)[0], "?", 2)[0]
+	ext := strings.ToLower(path.Ext(link))
+	for _, known := range imageExtensions {
+		if ext == known {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize decodes HTML entities and resolves link against base, which is the URL of the post.
+// Only http and https links are accepted.
+func normalize(raw string, base *url.URL) (string, bool) {
+	link := strings.TrimSpace(html.UnescapeString(raw))
+	if link == "" {
+		return "", false
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", false
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if (u.Scheme != "http") && (u.Scheme != "https") {
+		return "", false
+	}
+	return u.String(), true
+}
+
+func parseBase(base string) *url.URL {
+	u, err := url.Parse(base)
+	if (err != nil) || !u.IsAbs() {
+		return nil
+	}
+	return u
+}
+
+func parseSrcset(srcset string) []string {
+	var result []string
+	for _, candidate := range strings.Split(srcset, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) > 0 {
+			result = append(result, fields[0])
+		}
+	}
+	return result
+}
+
+// Find returns all image references in content: <img> and <source> sources and srcsets,
+// links to images and CSS url(...) in style attributes. Relative links are resolved against base.
+// Every URL is returned once.
+func Find(content, base string) []Reference {
+	var result []Reference
+	var seen map[string]int = make(map[string]int)
+	var base_url *url.URL = parseBase(base)
+	add := func(raw, kind string) int {
+		link, ok := normalize(raw, base_url)
+		if !ok {
+			return -1
+		}
+		if index, ok := seen[link]; ok {
+			return index
+		}
+		seen[link] = len(result)
+		result = append(result, Reference{URL: link, Raw: raw, Kind: kind})
+		return len(result) - 1
+	}
+
+	// link to a full-size image which is still open
+	var link int = -1
+	for _, tag := range tagPattern.FindAllStringSubmatch(content, -1) {
+		closing, name, attrs := tag[1] == "/", strings.ToLower(tag[2]), attributes(tag[3])
+		if name == "a" {
+			link = -1
+			if !closing && looksLikeImage(attrs["href"]) {
+				link = add(attrs["href"], KindLink)
+			}
+			continue
+		}
+		if closing {
+			continue
+		}
+		if (name == "img") || (name == "source") {
+			if src, ok := attrs["src"]; ok {
+				index := add(src, KindSrc)
+				if (name == "img") && (link >= 0) && (index >= 0) && (result[link].Thumbnail == "") {
+					result[link].Thumbnail = result[index].URL
+				}
+			}
+			for _, candidate := range parseSrcset(attrs["srcset"]) {
+				add(candidate, KindSrcset)
+			}
+		}
+		for _, match := range cssURLPattern.FindAllStringSubmatch(attrs["style"], -1) {
+			add(match[1] + match[2] + match[3], KindCSS)
+		}
+	}
+	return result
+}
+
+// Rewrite replaces image references in markup according to mapping from Reference.URL to the new URL.
+// New URLs are HTML-encoded, everything else is left as is.
+func Rewrite(content, base string, mapping map[string]string) string {
+	var base_url *url.URL = parseBase(base)
+	replace := func(raw string) string {
+		link, ok := normalize(raw, base_url)
+		if !ok {
+			return raw
+		}
+		if new_link, ok := mapping[link]; ok {
+			return html.EscapeString(new_link)
+		}
+		return raw
+	}
+	return tagPattern.ReplaceAllStringFunc(content, func(tag string) string {
+		return attributePattern.ReplaceAllStringFunc(tag, func(attr string) string {
+			match := attributePattern.FindStringSubmatch(attr)
+			name, value := strings.ToLower(match[1]), match[2] + match[3] + match[4]
+			var new_value string
+			switch name {
+				case "src", "href":
+					new_value = replace(value)
+				case "srcset":
+					var candidates []string
+					for _, candidate := range strings.Split(value, ",") {
+						fields := strings.Fields(candidate)
+						if len(fields) > 0 {
+							fields[0] = replace(fields[0])
+						}
+						candidates = append(candidates, strings.Join(fields, " "))
+					}
+					new_value = strings.Join(candidates, ", ")
+				case "style":
+					new_value = cssURLPattern.ReplaceAllStringFunc(value, func(css string) string {
+						m := cssURLPattern.FindStringSubmatch(css)
+						return "url(" + replace(m[1] + m[2] + m[3]) + ")"
+					})
+				default:
+					return attr
+			}
+			if new_value == value {
+				return attr
+			}
+			// new URLs never contain quotes as they are escaped, but the rest of style might
+			if strings.Contains(new_value, "\"") {
+				return match[1] + "='" + new_value + "'"
+			}
+			return match[1] + "=\"" + new_value + "\""
+		})
+	})
+}
+
+// Extract returns URLs of all images referenced in content, each one once.
+func Extract(content, base string) []string {
+	var result []string
+	for _, ref := range Find(content, base) {
+		result = append(result, ref.URL)
+	}
+	return result
+}
@@ -0,0 +1,363 @@
+package images
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+)
+
+// Standard library knows only GIF, JPEG and PNG, other formats met in journals are handled here.
+
+var errNoDecoder = errors.New("Decoding of this format is not supported")
+
+// Decoded images are kept in memory whole, anything bigger than this is refused before allocating it.
+const MAX_SIDE = 1 << 15
+const MAX_PIXELS = 1 << 26
+
+// checkDimensions is done before any multiplication of the dimensions, so that it can't overflow.
+func checkDimensions(width, height int) error {
+	if (width <= 0) || (height <= 0) {
+		return errors.New("Bad image dimensions")
+	}
+	if (width > MAX_SIDE) || (height > MAX_SIDE) || (width * height > MAX_PIXELS) {
+		return fmt.Errorf("Image is too large to decode, %dx%d", width, height)
+	}
+	return nil
+}
+
+func init() {
+	image.RegisterFormat("bmp", "BM", decodeBMP, decodeBMPConfig)
+	image.RegisterFormat("webp", "RIFF????WEBP", decodeUnsupported, decodeWebPConfig)
+	image.RegisterFormat("tiff", "II\x2A\x00", decodeTIFF, decodeTIFFConfig)
+	image.RegisterFormat("tiff", "MM\x00\x2A", decodeTIFF, decodeTIFFConfig)
+}
+
+func decodeUnsupported(r io.Reader) (image.Image, error) {
+	return nil, errNoDecoder
+}
+
+func readHeader(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+func decodeBMPConfig(r io.Reader) (image.Config, error) {
+	header, err := readHeader(r, 26)
+	if err != nil {
+		return image.Config{}, err
+	}
+	width := int32(binary.LittleEndian.Uint32(header[18:22]))
+	height := int32(binary.LittleEndian.Uint32(header[22:26]))
+	// negative height means top-down bitmap
+	if height < 0 {
+		height = -height
+	}
+	return image.Config{ColorModel: color.RGBAModel, Width: int(width), Height: int(height)}, nil
+}
+
+func decodeWebPConfig(r io.Reader) (image.Config, error) {
+	header, err := readHeader(r, 30)
+	if err != nil {
+		return image.Config{}, err
+	}
+	config := image.Config{ColorModel: color.RGBAModel}
+	chunk := header[12:30]
+	switch string(chunk[0:4]) {
+		case "VP8 ":
+			config.Width = int(binary.LittleEndian.Uint16(chunk[14:16]) & 0x3fff)
+			config.Height = int(binary.LittleEndian.Uint16(chunk[16:18]) & 0x3fff)
+		case "VP8L":
+			bits := binary.LittleEndian.Uint32(chunk[9:13])
+			config.Width = int(bits & 0x3fff) + 1
+			config.Height = int((bits >> 14) & 0x3fff) + 1
+		case "VP8X":
+			config.Width = int(uint32(chunk[12]) | uint32(chunk[13]) << 8 | uint32(chunk[14]) << 16) + 1
+			config.Height = int(uint32(chunk[15]) | uint32(chunk[16]) << 8 | uint32(chunk[17]) << 16) + 1
+		default:
+			return image.Config{}, errors.New("Unknown WebP chunk")
+	}
+	return config, nil
+}
+
+// decodeBMP supports uncompressed 8-bit paletted, 24-bit and 32-bit bitmaps, which is what people usually have.
+func decodeBMP(r io.Reader) (image.Image, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 54 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	pixels := int(binary.LittleEndian.Uint32(data[10:14]))
+	dib := int(binary.LittleEndian.Uint32(data[14:18]))
+	width := int(int32(binary.LittleEndian.Uint32(data[18:22])))
+	height := int(int32(binary.LittleEndian.Uint32(data[22:26])))
+	bpp := int(binary.LittleEndian.Uint16(data[28:30]))
+	compression := binary.LittleEndian.Uint32(data[30:34])
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+	if err := checkDimensions(width, height); err != nil {
+		return nil, err
+	}
+	if (compression != 0) && !((compression == 3) && (bpp == 32)) {
+		return nil, errNoDecoder
+	}
+
+	var palette color.Palette
+	if bpp == 8 {
+		count := int(binary.LittleEndian.Uint32(data[46:50]))
+		if count == 0 {
+			count = 256
+		}
+		for i := 0; i < count; i++ {
+			entry := 14 + dib + i*4
+			if entry + 4 > len(data) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			palette = append(palette, color.RGBA{data[entry+2], data[entry+1], data[entry], 0xff})
+		}
+	} else if (bpp != 24) && (bpp != 32) {
+		return nil, errNoDecoder
+	}
+
+	stride := ((width * bpp + 31) / 32) * 4
+	if pixels + stride * height > len(data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	result := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := data[pixels + y*stride:]
+		var target int = height - 1 - y
+		if topDown {
+			target = y
+		}
+		for x := 0; x < width; x++ {
+			var c color.RGBA
+			switch bpp {
+				case 8:
+					index := int(row[x])
+					if index >= len(palette) {
+						return nil, errors.New("Bad BMP palette index")
+					}
+					c = palette[index].(color.RGBA)
+				case 24:
+					c = color.RGBA{row[x*3+2], row[x*3+1], row[x*3], 0xff}
+				case 32:
+					c = color.RGBA{row[x*4+2], row[x*4+1], row[x*4], 0xff}
+			}
+			result.SetRGBA(x, target, c)
+		}
+	}
+	return result, nil
+}
+
+type tiffIFD struct {
+	data	[]byte
+	order	binary.ByteOrder
+	entries	map[uint16][]int
+}
+
+// readTIFFIFD parses the first IFD, values of SHORT and LONG tags are collected.
+func readTIFFIFD(r io.Reader) (tiffIFD, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return tiffIFD{}, err
+	}
+	if len(data) < 8 {
+		return tiffIFD{}, io.ErrUnexpectedEOF
+	}
+	ifd := tiffIFD{data: data, order: binary.LittleEndian, entries: make(map[uint16][]int)}
+	if data[0] == 'M' {
+		ifd.order = binary.BigEndian
+	}
+	offset := int(ifd.order.Uint32(data[4:8]))
+	if offset + 2 > len(data) {
+		return tiffIFD{}, io.ErrUnexpectedEOF
+	}
+	count := int(ifd.order.Uint16(data[offset:offset+2]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry + 12 > len(data) {
+			return tiffIFD{}, io.ErrUnexpectedEOF
+		}
+		tag := ifd.order.Uint16(data[entry:entry+2])
+		kind := ifd.order.Uint16(data[entry+2:entry+4])
+		n := int(ifd.order.Uint32(data[entry+4:entry+8]))
+		var size int
+		switch kind {
+			case 3: size = 2
+			case 4: size = 4
+			default: continue
+		}
+		var values int = entry + 8
+		if n * size > 4 {
+			values = int(ifd.order.Uint32(data[entry+8:entry+12]))
+		}
+		if (n < 0) || (values + n * size > len(data)) {
+			continue
+		}
+		for j := 0; j < n; j++ {
+			if size == 2 {
+				ifd.entries[tag] = append(ifd.entries[tag], int(ifd.order.Uint16(data[values+j*2:])))
+			} else {
+				ifd.entries[tag] = append(ifd.entries[tag], int(ifd.order.Uint32(data[values+j*4:])))
+			}
+		}
+	}
+	return ifd, nil
+}
+
+func (ifd tiffIFD) get(tag uint16, fallback int) int {
+	if values := ifd.entries[tag]; len(values) > 0 {
+		return values[0]
+	}
+	return fallback
+}
+
+// decodeTIFFConfig looks only at the first IFD, which must be within the fetched part of the file.
+func decodeTIFFConfig(r io.Reader) (image.Config, error) {
+	ifd, err := readTIFFIFD(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	config := image.Config{ColorModel: color.RGBAModel, Width: ifd.get(256, 0), Height: ifd.get(257, 0)}
+	if (config.Width == 0) || (config.Height == 0) {
+		return image.Config{}, errors.New("No dimensions in TIFF")
+	}
+	return config, nil
+}
+
+// decodeTIFF supports uncompressed 8-bit grayscale, RGB and RGBA strips.
+func decodeTIFF(r io.Reader) (image.Image, error) {
+	ifd, err := readTIFFIFD(r)
+	if err != nil {
+		return nil, err
+	}
+	width, height := ifd.get(256, 0), ifd.get(257, 0)
+	samples := ifd.get(277, 1)
+	if err := checkDimensions(width, height); err != nil {
+		return nil, err
+	}
+	if (ifd.get(259, 1) != 1) || (ifd.get(258, 8) != 8) || (ifd.get(284, 1) != 1) {
+		return nil, errNoDecoder
+	}
+	photometric := ifd.get(262, 2)
+	if !((photometric == 1) && (samples == 1)) && !((photometric == 2) && ((samples == 3) || (samples == 4))) {
+		return nil, errNoDecoder
+	}
+
+	var pixels []byte
+	offsets, counts := ifd.entries[273], ifd.entries[279]
+	if len(offsets) != len(counts) {
+		return nil, errors.New("Bad TIFF strips")
+	}
+	for i := range offsets {
+		if (offsets[i] < 0) || (counts[i] < 0) || (offsets[i] + counts[i] > len(ifd.data)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		pixels = append(pixels, ifd.data[offsets[i]:offsets[i]+counts[i]]...)
+	}
+	if len(pixels) < width * height * samples {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	result := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := pixels[(y*width + x)*samples:]
+			switch samples {
+				case 1: result.SetRGBA(x, y, color.RGBA{p[0], p[0], p[0], 0xff})
+				case 3: result.SetRGBA(x, y, color.RGBA{p[0], p[1], p[2], 0xff})
+				case 4: result.Set(x, y, color.NRGBA{p[0], p[1], p[2], p[3]})
+			}
+		}
+	}
+	return result, nil
+}
+
+// isAnimated tells whenever image of format has more than one frame. Only the fetched part is examined.
+func isAnimated(format string, data []byte) bool {
+	switch format {
+		case "gif": return countGIFFrames(data) > 1
+		case "png":
+			// APNG has acTL chunk before the first IDAT
+			idat := bytes.Index(data, []byte("IDAT"))
+			actl := bytes.Index(data, []byte("acTL"))
+			return (actl >= 0) && ((idat < 0) || (actl < idat))
+		case "webp":
+			// animation flag of VP8X chunk
+			return (len(data) > 20) && (string(data[12:16]) == "VP8X") && (data[20] & 0x02 != 0)
+	}
+	return false
+}
+
+func countGIFFrames(data []byte) int {
+	r := bufio.NewReader(bytes.NewReader(data))
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0
+	}
+	if header[10] & 0x80 != 0 {
+		r.Discard(3 << (uint(header[10] & 0x07) + 1))
+	}
+	var frames int = 0
+	skipBlocks := func() bool {
+		for {
+			size, err := r.ReadByte()
+			if err != nil {
+				return false
+			}
+			if size == 0 {
+				return true
+			}
+			if _, err := r.Discard(int(size)); err != nil {
+				return false
+			}
+		}
+	}
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return frames
+		}
+		switch kind {
+			case 0x21:
+				if _, err := r.ReadByte(); err != nil {
+					return frames
+				}
+				if !skipBlocks() {
+					return frames
+				}
+			case 0x2C:
+				frames++
+				if frames > 1 {
+					return frames
+				}
+				descriptor := make([]byte, 9)
+				if _, err := io.ReadFull(r, descriptor); err != nil {
+					return frames
+				}
+				if descriptor[8] & 0x80 != 0 {
+					r.Discard(3 << (uint(descriptor[8] & 0x07) + 1))
+				}
+				// LZW minimum code size
+				if _, err := r.ReadByte(); err != nil {
+					return frames
+				}
+				if !skipBlocks() {
+					return frames
+				}
+			default:
+				return frames
+		}
+	}
+}
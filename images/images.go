@@ -0,0 +1,318 @@
+// Package images finds images in post content and collects information about them.
+package images
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"../rules"
+)
+
+// Settings describe how placeholder images of dying hosts can be recognized.
+type Settings struct {
+	PlaceholderHashes	[]string	`json:"placeholder_hashes"`
+	PlaceholderURLs		[]string	`json:"placeholder_urls"`
+	PlaceholderSizes	[]string	`json:"placeholder_sizes"`
+}
+
+var Config Settings = Settings {
+	PlaceholderHashes: []string{},
+	PlaceholderURLs: []string{"i.imgur.com/removed.png", "/photo_unavailable", "/bandwidth"},
+	PlaceholderSizes: []string{},
+}
+
+// Images are fetched the same way the journal page would do it, so that hotlink protection kicks in.
+const REFERER = "https://www.livejournal.com/"
+
+const MAX_DOWNLOAD = 16 * 1024 * 1024
+
+// Client fetches images. The site, which looks at images of any link a user gives it,
+// replaces it with PublicClient.
+var Client *http.Client = http.DefaultClient
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// PublicClient refuses to connect to loopback, private and link-local addresses. The address is
+// checked when connecting, so redirects and names resolving to such addresses are refused too.
+func PublicClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if (ip == nil) || !isPublicIP(ip) {
+				return fmt.Errorf("%s : not a public address", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Transport: transport, Timeout: time.Minute}
+}
+
+type Image struct {
+	URL, Domain, Path, MIME, Class, FinalURL, Format string
+	Size, Width, Height int
+	Known, Animated bool
+}
+
+// GetInfo fills domain, path, type and size of the image. When HEAD doesn't tell them,
+// the image is requested with GET and measured. Known tells whenever it succeeded.
+func (i *Image) GetInfo() error {
+	u, err := url.Parse(i.URL)
+	if (err != nil) {
+		return err
+	}
+	i.Domain = u.Host
+	i.Path = u.Path
+	err = i.headInfo()
+	if err != nil {
+		err = i.getInfo()
+	}
+	i.Known = (err == nil)
+	return err
+}
+
+func (i *Image) headInfo() error {
+	head, err := Client.Head(i.URL)
+	if (err != nil) {
+		return err
+	}
+	head.Body.Close()
+	if (head.StatusCode != http.StatusOK) {
+		return errors.New("Unknown error : " + head.Status)
+	}
+	i.MIME = head.Header.Get("Content-Type")
+	i.Size, err = strconv.Atoi(head.Header.Get("Content-Length"));
+	if (err != nil) {
+		return err
+	}
+	if (i.MIME == "") || (i.MIME == "application/octet-stream") {
+		return errors.New("No content type")
+	}
+	return nil
+}
+
+// getInfo asks for the first bytes only, hosts which ignore Range are measured by reading the whole body.
+func (i *Image) getInfo() error {
+	const SNIFF_LENGTH = 512
+	req, err := http.NewRequest("GET", i.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", SNIFF_LENGTH - 1))
+	resp, err := Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	head, err := ioutil.ReadAll(io.LimitReader(resp.Body, SNIFF_LENGTH))
+	if err != nil {
+		return err
+	}
+	i.MIME = resp.Header.Get("Content-Type")
+	if (i.MIME == "") || (i.MIME == "application/octet-stream") {
+		i.MIME = http.DetectContentType(head)
+	}
+
+	switch resp.StatusCode {
+		case http.StatusPartialContent:
+			// Content-Range: bytes 0-511/12345
+			content_range := resp.Header.Get("Content-Range")
+			slash := strings.LastIndex(content_range, "/")
+			if slash < 0 {
+				return errors.New("Bad Content-Range : " + content_range)
+			}
+			i.Size, err = strconv.Atoi(content_range[slash+1:])
+			return err
+		case http.StatusOK:
+			rest, err := io.Copy(ioutil.Discard, io.LimitReader(resp.Body, MAX_DOWNLOAD))
+			if err != nil {
+				return err
+			}
+			if int(rest) + len(head) > MAX_DOWNLOAD {
+				return errors.New("Image is too big to measure")
+			}
+			i.Size = int(rest) + len(head)
+			return nil
+	}
+	return errors.New("Unknown error : " + resp.Status)
+}
+
+// Inspect reads the beginning of the image to find its format, dimensions and whenever it is animated.
+func (i *Image) Inspect() error {
+	const INSPECT_LENGTH = 64 * 1024
+	req, err := http.NewRequest("GET", i.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", INSPECT_LENGTH - 1))
+	resp, err := Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if (resp.StatusCode != http.StatusOK) && (resp.StatusCode != http.StatusPartialContent) {
+		return errors.New("Unknown error : " + resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, INSPECT_LENGTH))
+	if err != nil {
+		return err
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	i.Format = format
+	i.Width = config.Width
+	i.Height = config.Height
+	i.Animated = isAnimated(format, data)
+	return nil
+}
+
+func isPlaceholderURL(link string) bool {
+	for _, pattern := range Config.PlaceholderURLs {
+		if strings.Contains(link, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPlaceholderData(data []byte, redirected bool) bool {
+	sum := md5.Sum(data)
+	hash := hex.EncodeToString(sum[:])
+	for _, known := range Config.PlaceholderHashes {
+		if strings.EqualFold(known, hash) {
+			return true
+		}
+	}
+	if !redirected {
+		return false
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	size := fmt.Sprintf("%dx%d", config.Width, config.Height)
+	for _, known := range Config.PlaceholderSizes {
+		if known == size {
+			return true
+		}
+	}
+	return false
+}
+
+// Classify downloads the image following redirects and sorts it as ok, dead, placeholder or blocked.
+func (i *Image) Classify() string {
+	i.Class = i.classify()
+	return i.Class
+}
+
+func (i *Image) classify() string {
+	req, err := http.NewRequest("GET", i.URL, nil)
+	if err != nil {
+		return rules.ClassDead
+	}
+	req.Header.Set("Referer", REFERER)
+	resp, err := Client.Do(req)
+	if err != nil {
+		return rules.ClassDead
+	}
+	defer resp.Body.Close()
+
+	i.FinalURL = resp.Request.URL.String()
+	redirected := (i.FinalURL != i.URL)
+	switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests, http.StatusUnavailableForLegalReasons:
+			return rules.ClassBlocked
+		default:
+			return rules.ClassDead
+	}
+	if redirected && isPlaceholderURL(i.FinalURL) {
+		return rules.ClassPlaceholder
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") {
+		// hotlink protection usually redirects to the hosting's own page
+		if redirected {
+			return rules.ClassBlocked
+		}
+		return rules.ClassDead
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_DOWNLOAD))
+	if err != nil {
+		return rules.ClassDead
+	}
+	if isPlaceholderData(data, redirected) {
+		return rules.ClassPlaceholder
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); (err != nil) && (err != image.ErrFormat) {
+		return rules.ClassDead
+	}
+	return rules.ClassOK
+}
+
+// Attributes returns what rules know about the image.
+func (i *Image) Attributes() rules.Image {
+	var info string = rules.InfoUnknown
+	if i.Known {
+		info = rules.InfoKnown
+	}
+	return rules.Image{
+		Info: info,
+		URL: i.URL,
+		Domain: i.Domain,
+		Path: i.Path,
+		MIME: i.MIME,
+		Class: i.Class,
+		Format: i.Format,
+		Animated: i.Animated,
+		Size: i.Size,
+		Width: i.Width,
+		Height: i.Height,
+	}
+}
+
+// Examine collects attributes which are expensive to find, but only those the rule set looks at.
+func (i *Image) Examine(set *rules.Set) error {
+	var err error = nil
+	if set.Uses("class") {
+		i.Classify()
+	}
+	if set.Uses("width", "height", "format", "animated") {
+		err = i.Inspect()
+	}
+	return err
+}
+
+// Check tells whenever image should be reuploaded according to rule set.
+func (i *Image) Check(set *rules.Set) bool {
+	action, _ := set.Check(i.Attributes())
+	return action == rules.Reupload
+}
@@ -0,0 +1,343 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Processing describes what is done with an image between downloading and uploading it.
+type Processing struct {
+	Transcode		bool	`json:"transcode"`
+	TranscodeFormat	string	`json:"transcode_format"`
+	MaxDimension	int		`json:"max_dimension"`
+	MaxSize			int		`json:"max_size"`
+	StripMetadata	bool	`json:"strip_metadata"`
+}
+
+// Enabled tells whenever images have to be downloaded and processed at all.
+func (p Processing) Enabled() bool {
+	return p.Transcode || (p.MaxDimension > 0) || (p.MaxSize > 0) || p.StripMetadata
+}
+
+const JPEG_QUALITY = 90
+
+// Download fetches the whole image.
+func (i *Image) Download() ([]byte, error) {
+	resp, err := Client.Get(i.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Unknown error : " + resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_DOWNLOAD + 1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MAX_DOWNLOAD {
+		return nil, errors.New("Image is too big to process")
+	}
+	return data, nil
+}
+
+// Process applies processing to image data. If nothing had to be done, the same data is returned.
+func Process(data []byte, p Processing) ([]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return data, err
+	}
+	// re-encoding would lose the animation
+	if isAnimated(format, data) {
+		return data, nil
+	}
+
+	transcode := p.Transcode && ((format == "bmp") || (format == "tiff"))
+	tooLarge := (p.MaxDimension > 0) && ((config.Width > p.MaxDimension) || (config.Height > p.MaxDimension))
+	tooHeavy := (p.MaxSize > 0) && (len(data) > p.MaxSize)
+	if !transcode && !tooLarge && !tooHeavy {
+		if p.StripMetadata {
+			return stripMetadata(format, data), nil
+		}
+		return data, nil
+	}
+
+	if err := checkDimensions(config.Width, config.Height); err != nil {
+		return data, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data, err
+	}
+	// encoders write no EXIF, so the orientation is applied to the pixels
+	if format == "jpeg" {
+		img = orient(img, jpegOrientation(data))
+	}
+	if tooLarge {
+		img = fit(img, p.MaxDimension)
+	}
+
+	var target string = format
+	if transcode || ((format != "jpeg") && (format != "png")) {
+		target = p.TranscodeFormat
+	}
+	result, err := encode(img, target, JPEG_QUALITY)
+	if err != nil {
+		return data, err
+	}
+	// lower the quality first, then keep shrinking the image until it fits
+	for quality := JPEG_QUALITY; (p.MaxSize > 0) && (len(result) > p.MaxSize); {
+		if (target == "jpeg") && (quality > 60) {
+			quality -= 10
+		} else {
+			bounds := img.Bounds()
+			largest := bounds.Dx()
+			if bounds.Dy() > largest {
+				largest = bounds.Dy()
+			}
+			if largest < 64 {
+				break
+			}
+			img = fit(img, largest * 3 / 4)
+		}
+		result, err = encode(img, target, quality)
+		if err != nil {
+			return data, err
+		}
+	}
+	// encoders write no metadata, so there is nothing left to strip
+	if (len(result) >= len(data)) && !transcode && !tooLarge {
+		if p.StripMetadata {
+			return stripMetadata(format, data), nil
+		}
+		return data, nil
+	}
+	return result, nil
+}
+
+func encode(img image.Image, format string, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// fit scales image down so that none of its sides is longer than limit, averaging source pixels.
+func fit(img image.Image, limit int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if (width <= limit) && (height <= limit) {
+		return img
+	}
+	newWidth, newHeight := limit, height * limit / width
+	if height > width {
+		newWidth, newHeight = width * limit / height, limit
+	}
+	if newWidth < 1 {
+		newWidth = 1
+	}
+	if newHeight < 1 {
+		newHeight = 1
+	}
+	result := image.NewNRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := 0; y < newHeight; y++ {
+		y0, y1 := y * height / newHeight, (y + 1) * height / newHeight
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < newWidth; x++ {
+			x0, x1 := x * width / newWidth, (x + 1) * width / newWidth
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(img.At(bounds.Min.X + sx, bounds.Min.Y + sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			result.Set(x, y, color.NRGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return result
+}
+
+// stripMetadata removes EXIF, XMP, IPTC and text chunks without re-encoding the image.
+func stripMetadata(format string, data []byte) []byte {
+	switch format {
+		case "jpeg": return stripJPEG(data)
+		case "png": return stripPNG(data)
+	}
+	return data
+}
+
+// EXIF_ORIENTATION is the tag telling how the camera was held, viewers rotate the image by it.
+const EXIF_ORIENTATION = 0x0112
+
+// jpegOrientation finds the EXIF orientation of JPEG image, 1 means as stored.
+func jpegOrientation(data []byte) int {
+	if (len(data) < 2) || (data[0] != 0xFF) || (data[1] != 0xD8) {
+		return 1
+	}
+	for pos := 2; pos + 4 <= len(data); {
+		marker := data[pos+1]
+		if (data[pos] != 0xFF) || (marker == 0xDA) {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:pos+4]))
+		if pos + 2 + length > len(data) {
+			return 1
+		}
+		if marker == 0xE1 {
+			if orientation := exifOrientation(data[pos+4:pos+2+length]); orientation > 1 {
+				return orientation
+			}
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation from IFD0 of APP1 payload.
+func exifOrientation(payload []byte) int {
+	if (len(payload) < 14) || (string(payload[:6]) != "Exif\x00\x00") {
+		return 1
+	}
+	tiff := payload[6:]
+	var order binary.ByteOrder = binary.LittleEndian
+	if tiff[0] == 'M' {
+		order = binary.BigEndian
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if (offset < 8) || (offset + 2 > len(tiff)) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:offset+2]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry + 12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == EXIF_ORIENTATION {
+			orientation := int(order.Uint16(tiff[entry+8:entry+10]))
+			if (orientation < 1) || (orientation > 8) {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// orientationSegment is APP1 with EXIF holding nothing but the orientation.
+func orientationSegment(orientation int) []byte {
+	return []byte{0xFF, 0xE1, 0, 34, 'E', 'x', 'i', 'f', 0, 0,
+		'M', 'M', 0, 0x2A, 0, 0, 0, 8,
+		0, 1,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0,
+		0, 0, 0, 0}
+}
+
+// orient turns the image the way viewers would do it for EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+	if (orientation < 2) || (orientation > 8) {
+		return img
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	var result *image.NRGBA
+	if orientation >= 5 {
+		result = image.NewNRGBA(image.Rect(0, 0, height, width))
+	} else {
+		result = image.NewNRGBA(image.Rect(0, 0, width, height))
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var tx, ty int
+			switch orientation {
+				case 2: tx, ty = width - 1 - x, y
+				case 3: tx, ty = width - 1 - x, height - 1 - y
+				case 4: tx, ty = x, height - 1 - y
+				case 5: tx, ty = y, x
+				case 6: tx, ty = height - 1 - y, x
+				case 7: tx, ty = height - 1 - y, width - 1 - x
+				case 8: tx, ty = y, width - 1 - x
+			}
+			result.Set(tx, ty, img.At(bounds.Min.X + x, bounds.Min.Y + y))
+		}
+	}
+	return result
+}
+
+// stripJPEG drops metadata segments. The orientation is kept in a segment of its own,
+// otherwise photos taken by phones would be shown rotated.
+func stripJPEG(data []byte) []byte {
+	if (len(data) < 2) || (data[0] != 0xFF) || (data[1] != 0xD8) {
+		return data
+	}
+	var orientation int = jpegOrientation(data)
+	result := []byte{0xFF, 0xD8}
+	for pos := 2; pos + 4 <= len(data); {
+		if data[pos] != 0xFF {
+			return data
+		}
+		marker := data[pos+1]
+		// the rest is entropy-coded data
+		if marker == 0xDA {
+			return append(result, data[pos:]...)
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:pos+4]))
+		if pos + 2 + length > len(data) {
+			return data
+		}
+		// APP1 holds EXIF and XMP, APP13 holds IPTC, COM is a free text comment
+		if (marker != 0xE1) && (marker != 0xED) && (marker != 0xFE) {
+			result = append(result, data[pos:pos+2+length]...)
+		} else if (marker == 0xE1) && (orientation > 1) {
+			result = append(result, orientationSegment(orientation)...)
+			orientation = 1
+		}
+		pos += 2 + length
+	}
+	return data
+}
+
+func stripPNG(data []byte) []byte {
+	const SIGNATURE_LENGTH = 8
+	if len(data) < SIGNATURE_LENGTH {
+		return data
+	}
+	result := append([]byte{}, data[:SIGNATURE_LENGTH]...)
+	for pos := SIGNATURE_LENGTH; pos + 12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:pos+4]))
+		kind := string(data[pos+4:pos+8])
+		end := pos + 12 + length
+		if (length < 0) || (end > len(data)) {
+			return data
+		}
+		switch kind {
+			case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+			default:
+				result = append(result, data[pos:end]...)
+		}
+		pos = end
+	}
+	return result
+}
@@ -9,26 +9,37 @@ import (
 	"io/ioutil"
 	"encoding/json"
 	"strconv"
+	"encoding/base64"
 )
 
 type ImgurClient struct {
 	Locked 		bool		`json:"imgur_locked"`
 	ResetTime int			`json:"imgur_resetTime"`
+	Remaining int			`json:"-"`
 	ClientID	string	`json:"imgur_clientID"`
 	ClientSecret	string	`json:"imgur_clientSecret"`
 	MashapeKey 		string	`json:"imgur_mashapeKey"`
 }
 
 func (ic *ImgurClient) UploadImage(image_url string) (string, error) {
+	return ic.upload([]byte(image_url), "URL")
+}
+
+// UploadImageData uploads image bytes instead of letting Imgur fetch them.
+func (ic *ImgurClient) UploadImageData(data []byte) (string, error) {
+	return ic.upload([]byte(base64.StdEncoding.EncodeToString(data)), "base64")
+}
+
+func (ic *ImgurClient) upload(image []byte, kind string) (string, error) {
 	const UPLOAD_URL = "https://imgur-apiv3.p.mashape.com/3/image"
 
 	var buf bytes.Buffer
 	mpart := multipart.NewWriter(&buf)
 
 	field, _ := mpart.CreateFormField("image")
-	field.Write([]byte(image_url))
+	field.Write(image)
 	field, _ = mpart.CreateFormField("type")
-	field.Write([]byte("URL"))
+	field.Write([]byte(kind))
 
 	mpart.Close()
 
@@ -46,6 +57,7 @@ func (ic *ImgurClient) UploadImage(image_url string) (string, error) {
 	defer rsp.Body.Close()
 
 	ic.ResetTime, _ = strconv.Atoi(rsp.Header.Get("X-Post-Rate-Limit-Reset"))
+	ic.Remaining, _ = strconv.Atoi(rsp.Header.Get("X-Post-Rate-Limit-Remaining"))
 
 	body_bytes, _ := ioutil.ReadAll(rsp.Body)
 
@@ -11,19 +11,54 @@ import (
 	"bytes"
 	"fmt"
 	"bufio"
-	"path"
 	"strings"
 	"strconv"
 	"io"
+	"encoding/xml"
+	"log/slog"
+	"time"
+	"../metrics"
 )
 
+var requestDuration = metrics.NewHistogram("ljir_lj_request_duration_seconds", "Duration of LiveJournal requests until response headers.", metrics.DefaultBuckets, "endpoint", "result")
+
+// timedTransport measures every request made to LiveJournal.
+type timedTransport struct{}
+
+func (timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	var result string = "ok"
+	if (err != nil) || (resp.StatusCode >= 400) {
+		result = "error"
+	}
+	requestDuration.Observe(time.Since(start).Seconds(), req.URL.Path, result)
+	return resp, err
+}
+
+var httpClient *http.Client = &http.Client{Transport: timedTransport{}}
+
 type LJClient struct {
 	User string		`json:"user"`
 	PassHash string	`json:"passhash"`
 }
 
 type LJPost struct {
-	Header, Content, Year, Month, Day, Hour, Minute, Second, ID string
+	Header, Content, Year, Month, Day, Hour, Minute, Second, ID, Anum, Journal string
+}
+
+type LJUserpic struct {
+	Keyword, URL string
+}
+
+type LJComment struct {
+	ID			string	`xml:"id,attr"`
+	PostID		string	`xml:"jitemid,attr"`
+	PosterID	string	`xml:"posterid,attr"`
+	State		string	`xml:"state,attr"`
+	Subject		string	`xml:"subject"`
+	Body		string	`xml:"body"`
+	Poster		string	`xml:"-"`
 }
 
 func (lj *LJClient) getChallenge() (string, error) {
@@ -31,7 +66,7 @@ func (lj *LJClient) getChallenge() (string, error) {
 	const TYPE = "application/x-www-form-urlencoded"
 	const CONTENT = "mode=getchallenge"
 	contentReader := bytes.NewReader([]byte(CONTENT))
-	resp, err := http.Post(URL, TYPE, contentReader)
+	resp, err := httpClient.Post(URL, TYPE, contentReader)
 	if err != nil {
 		return "", err
 	}
@@ -68,7 +103,7 @@ func (lj *LJClient) TryLogIn() (bool, error) {
 	const CONTENT = "ver=1&mode=login&user=%s&auth_method=challenge&auth_challenge=%s&auth_response=%s"
 	content := fmt.Sprintf(CONTENT, lj.User, challenge, challenge_response)
 	contentReader := bytes.NewReader([]byte(content))
-	resp, err := http.Post(URL, TYPE, contentReader)
+	resp, err := httpClient.Post(URL, TYPE, contentReader)
 	if err != nil {
 		return false, err
 	}
@@ -82,6 +117,51 @@ func (lj *LJClient) TryLogIn() (bool, error) {
 	return true, err
 }
 
+// GetUserpics lists the account's userpics with their keywords.
+func (lj *LJClient) GetUserpics() ([]LJUserpic, error) {
+	challenge, challenge_response, err := lj.getChallengeData()
+	if err != nil {
+		return nil, err
+	}
+	const URL = "http://www.livejournal.com/interface/flat"
+	const TYPE = "application/x-www-form-urlencoded"
+	const CONTENT = "ver=1&mode=login&user=%s&auth_method=challenge&auth_challenge=%s&auth_response=%s&getpickws=1&getpickwurls=1"
+	content := fmt.Sprintf(CONTENT, lj.User, challenge, challenge_response)
+	contentReader := bytes.NewReader([]byte(content))
+	resp, err := httpClient.Post(URL, TYPE, contentReader)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var values map[string]string = make(map[string]string)
+	var prev string = ""
+	for true {
+		cur, is_last := readLine(resp.Body)
+		if prev != "" {
+			values[prev] = string(cur[:])
+			prev = ""
+		} else {
+			prev = string(cur[:])
+		}
+		if is_last {
+			break
+		}
+	}
+	if values["errmsg"] != "" {
+		return nil, errors.New(values["errmsg"])
+	}
+	count, _ := strconv.Atoi(values["pickwurl_count"])
+	var result []LJUserpic
+	for i := 1; i <= count; i++ {
+		index := strconv.Itoa(i)
+		result = append(result, LJUserpic{Keyword: values["pickw_" + index], URL: values["pickwurl_" + index]})
+	}
+	if values["defaultpicurl"] != "" {
+		result = append(result, LJUserpic{Keyword: "default", URL: values["defaultpicurl"]})
+	}
+	return result, nil
+}
+
 func readLine(reader io.Reader) ([]byte, bool) {
 	buf := make([]byte,1)
 	var res []byte
@@ -105,17 +185,20 @@ func (lj *LJClient) EditPost(post LJPost) error {
 	}
 	const URL = "http://www.livejournal.com/interface/flat"
 	const TYPE = "application/x-www-form-urlencoded"
-	const CONTENT = "mode=editevent&user=%s&auth_method=challenge&auth_challenge=%s&auth_response=%s&ver=1&itemid=%s&event=%s&subject=%s&year=%s&mon=%s&day=%s&hour=%s&min=%s"
+	const CONTENT = "mode=editevent&user=%s&auth_method=challenge&auth_challenge=%s&auth_response=%s&ver=1&itemid=%s&event=%s&subject=%s&year=%s&mon=%s&day=%s&hour=%s&min=%s&usejournal=%s"
 
-	content := fmt.Sprintf(CONTENT, lj.User, challenge, challenge_response, post.ID, url.QueryEscape(post.Content), url.QueryEscape(post.Header), post.Year, post.Month, post.Day, post.Hour, post.Minute)
+	content := fmt.Sprintf(CONTENT, lj.User, challenge, challenge_response, post.ID, url.QueryEscape(post.Content), url.QueryEscape(post.Header), post.Year, post.Month, post.Day, post.Hour, post.Minute, url.QueryEscape(post.Journal))
 	contentReader := bytes.NewReader([]byte(content))
 
-	resp, err := http.Post(URL, TYPE, contentReader)
+	resp, err := httpClient.Post(URL, TYPE, contentReader)
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		buf, _ := ioutil.ReadAll(resp.Body)
-		fmt.Println(string(buf))
+		slog.Debug("editevent response", "status", resp.Status, "body", string(buf))
 		return errors.New(resp.Status)
 	}
 
@@ -129,14 +212,15 @@ func (lj *LJClient) GetPost(post_url string) (LJPost, error) {
 	}
 	const URL = "http://www.livejournal.com/interface/flat"
 	const TYPE = "application/x-www-form-urlencoded"
-	const CONTENT = "ver=1&mode=getevents&user=%s&auth_method=challenge&auth_challenge=%s&auth_response=%s&selecttype=one&itemid=%s"
-	_, public_id := path.Split(post_url)
-	public_id = strings.TrimSuffix(public_id, path.Ext(public_id))
-	public_id_i, _ := strconv.Atoi(public_id)
-	var post_id string = strconv.Itoa((public_id_i - (public_id_i - (public_id_i / 256)*256)) / 256)
-	content := fmt.Sprintf(CONTENT, lj.User, challenge, challenge_response, post_id)
+	const CONTENT = "ver=1&mode=getevents&user=%s&auth_method=challenge&auth_challenge=%s&auth_response=%s&selecttype=one&itemid=%s&usejournal=%s"
+	parsed, err := ParsePostURL(post_url)
+	if err != nil {
+		return LJPost{}, err
+	}
+	var post_id string = strconv.Itoa(parsed.ItemID)
+	content := fmt.Sprintf(CONTENT, lj.User, challenge, challenge_response, post_id, url.QueryEscape(parsed.Journal))
 	contentReader := bytes.NewReader([]byte(content))
-	resp, err := http.Post(URL, TYPE, contentReader)
+	resp, err := httpClient.Post(URL, TYPE, contentReader)
 	if err != nil {
 		return LJPost{}, err
 	}
@@ -144,11 +228,13 @@ func (lj *LJClient) GetPost(post_url string) (LJPost, error) {
 	var prev string = ""
 	var result LJPost
 	result.ID = post_id
+	result.Journal = parsed.Journal
 	for true {
 		cur, is_last := readLine(resp.Body)
 		switch prev {
 			case "events_1_event": result.Content = string(cur[:])
 			case "events_1_subject": result.Header = string(cur[:])
+			case "events_1_anum": result.Anum = string(cur[:])
 			case "events_1_eventtime": {
 				datetime := strings.Split(string(cur[:]), " ")
 				date := strings.Split(datetime[0], "-")
@@ -170,3 +256,157 @@ func (lj *LJClient) GetPost(post_url string) (LJPost, error) {
 	result.Content = html.UnescapeString(text)
 	return result, err
 }
+
+func (lj *LJClient) generateSession() (string, error) {
+	challenge, challenge_response, err := lj.getChallengeData()
+	if err != nil {
+		return "", err
+	}
+	const URL = "http://www.livejournal.com/interface/flat"
+	const TYPE = "application/x-www-form-urlencoded"
+	const CONTENT = "ver=1&mode=sessiongenerate&user=%s&auth_method=challenge&auth_challenge=%s&auth_response=%s&expiration=short"
+	content := fmt.Sprintf(CONTENT, lj.User, challenge, challenge_response)
+	contentReader := bytes.NewReader([]byte(content))
+	resp, err := httpClient.Post(URL, TYPE, contentReader)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	var prev string = ""
+	for scanner.Scan() {
+		switch prev {
+			case "ljsession": return scanner.Text(), nil
+			case "errmsg": return "", errors.New(scanner.Text())
+		}
+		prev = scanner.Text()
+	}
+	return "", errors.New("No session in response")
+}
+
+type commentExport struct {
+	MaxID		int				`xml:"maxid"`
+	Comments	[]LJComment		`xml:"comments>comment"`
+	Users		[]struct {
+		ID		string	`xml:"id,attr"`
+		User	string	`xml:"user,attr"`
+	}	`xml:"usermaps>usermap"`
+}
+
+func exportComments(session, get string, startid int) (commentExport, error) {
+	const URL = "http://www.livejournal.com/export_comments.bml?get=%s&startid=%d"
+	req, err := http.NewRequest("GET", fmt.Sprintf(URL, get, startid), nil)
+	if err != nil {
+		return commentExport{}, err
+	}
+	req.Header.Add("Cookie", "ljsession=" + session)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return commentExport{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return commentExport{}, errors.New(resp.Status)
+	}
+	var result commentExport
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	return result, err
+}
+
+// GetComments exports all comments of the user's own journal, resolving poster names.
+// Comment ids and jitemids are only valid in that journal.
+func (lj *LJClient) GetComments() ([]LJComment, error) {
+	session, err := lj.generateSession()
+	if err != nil {
+		return nil, err
+	}
+	var users map[string]string = make(map[string]string)
+	var maxid int = 0
+	for startid := 0; ; {
+		meta, err := exportComments(session, "comment_meta", startid)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range meta.Users {
+			users[user.ID] = user.User
+		}
+		maxid = meta.MaxID
+		if len(meta.Comments) == 0 {
+			break
+		}
+		last, err := strconv.Atoi(meta.Comments[len(meta.Comments)-1].ID)
+		if err != nil {
+			return nil, err
+		}
+		// a page which doesn't move forward would be fetched again and again
+		if (last >= maxid) || (last + 1 <= startid) {
+			break
+		}
+		startid = last + 1
+	}
+	var result []LJComment
+	for startid := 0; startid <= maxid; {
+		body, err := exportComments(session, "comment_body", startid)
+		if err != nil {
+			return nil, err
+		}
+		if len(body.Comments) == 0 {
+			break
+		}
+		for _, comment := range body.Comments {
+			comment.Poster = users[comment.PosterID]
+			result = append(result, comment)
+		}
+		last, err := strconv.Atoi(body.Comments[len(body.Comments)-1].ID)
+		if err != nil {
+			return nil, err
+		}
+		if last + 1 <= startid {
+			break
+		}
+		startid = last + 1
+	}
+	return result, nil
+}
+
+// EditComment replaces subject and body of a comment made on post.
+func (lj *LJClient) EditComment(post LJPost, comment LJComment) error {
+	challenge, challenge_response, err := lj.getChallengeData()
+	if err != nil {
+		return err
+	}
+	const URL = "http://www.livejournal.com/interface/flat"
+	const TYPE = "application/x-www-form-urlencoded"
+	const CONTENT = "ver=1&mode=editcomment&user=%s&auth_method=challenge&auth_challenge=%s&auth_response=%s&dtalkid=%d&body=%s&subject=%s&usejournal=%s"
+
+	id, err := strconv.Atoi(comment.ID)
+	if err != nil {
+		return err
+	}
+	anum, err := strconv.Atoi(post.Anum)
+	if err != nil {
+		return err
+	}
+	content := fmt.Sprintf(CONTENT, lj.User, challenge, challenge_response, id*256 + anum, url.QueryEscape(comment.Body), url.QueryEscape(comment.Subject), url.QueryEscape(post.Journal))
+	contentReader := bytes.NewReader([]byte(content))
+
+	resp, err := httpClient.Post(URL, TYPE, contentReader)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return errors.New(resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	var prev string = ""
+	for scanner.Scan() {
+		if prev == "errmsg" {
+			return errors.New(scanner.Text())
+		}
+		prev = scanner.Text()
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package ljapi
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LJPostURL is a parsed link to a journal entry.
+type LJPostURL struct {
+	Journal string
+	DItemID, ItemID, Anum int
+}
+
+const LJ_DOMAIN = "livejournal.com"
+
+// journal names go into request bodies, so anything else is refused
+var journalPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// CanonicalJournal is the form LJ keeps journal and user names in: lowercase, with underscores.
+func CanonicalJournal(name string) string {
+	return strings.ToLower(strings.Replace(name, "-", "_", -1))
+}
+
+// ValidJournal tells whenever name may be a journal or user name, those go into request bodies unescaped.
+func ValidJournal(name string) bool {
+	return journalPattern.MatchString(name)
+}
+
+// ParsePostURL extracts journal name and entry ids from a link to LJ post.
+// Query strings such as ?thread= and fragments such as #cutid1 are ignored.
+func ParsePostURL(link string) (LJPostURL, error) {
+	link = strings.TrimSpace(link)
+	if link == "" {
+		return LJPostURL{}, errors.New("empty link")
+	}
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return LJPostURL{}, fmt.Errorf("%s : malformed link", link)
+	}
+	if (u.Scheme != "http") && (u.Scheme != "https") {
+		return LJPostURL{}, fmt.Errorf("%s : unsupported scheme %s", link, u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if !strings.HasSuffix(host, "." + LJ_DOMAIN) {
+		return LJPostURL{}, fmt.Errorf("%s : not a LiveJournal link", link)
+	}
+	subdomain := strings.TrimSuffix(host, "." + LJ_DOMAIN)
+
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	var result LJPostURL
+	switch {
+		case (subdomain == "www") && (len(segments) == 3) && (segments[0] == "users"):
+			result.Journal = segments[1]
+			segments = segments[2:]
+		case ((subdomain == "users") || (subdomain == "community") || (subdomain == "syndicated")) && (len(segments) == 2):
+			result.Journal = segments[0]
+			segments = segments[1:]
+		case (subdomain != "www") && (subdomain != "users") && !strings.Contains(subdomain, ".") && (len(segments) == 1):
+			result.Journal = strings.Replace(subdomain, "-", "_", -1)
+		default:
+			return LJPostURL{}, fmt.Errorf("%s : not a link to a post", link)
+	}
+	if result.Journal == "" {
+		return LJPostURL{}, fmt.Errorf("%s : no journal name", link)
+	}
+	if !ValidJournal(result.Journal) {
+		return LJPostURL{}, fmt.Errorf("%s : invalid journal name", link)
+	}
+
+	if path.Ext(segments[0]) != ".html" {
+		return LJPostURL{}, fmt.Errorf("%s : not a link to a post", link)
+	}
+	result.DItemID, err = strconv.Atoi(strings.TrimSuffix(segments[0], ".html"))
+	if (err != nil) || (result.DItemID <= 0) {
+		return LJPostURL{}, fmt.Errorf("%s : invalid post id", link)
+	}
+	result.ItemID = result.DItemID / 256
+	result.Anum = result.DItemID % 256
+	if result.ItemID == 0 {
+		return LJPostURL{}, fmt.Errorf("%s : invalid post id", link)
+	}
+	return result, nil
+}
+
+// String returns canonical link to the post.
+func (p LJPostURL) String() string {
+	if strings.HasPrefix(p.Journal, "_") || strings.HasSuffix(p.Journal, "_") {
+		return fmt.Sprintf("https://users.%s/%s/%d.html", LJ_DOMAIN, p.Journal, p.DItemID)
+	}
+	return fmt.Sprintf("https://%s.%s/%d.html", strings.Replace(p.Journal, "_", "-", -1), LJ_DOMAIN, p.DItemID)
+}
@@ -0,0 +1,89 @@
+package ljapi
+
+import (
+	"testing"
+)
+
+func TestParsePostURL(t *testing.T) {
+	var valid = []struct {
+		link	string
+		journal	string
+		ditemid	int
+	}{
+		{"https://user.livejournal.com/256.html", "user", 256},
+		{"user.livejournal.com/256.html", "user", 256},
+		{"http://some-user.livejournal.com/513.html", "some_user", 513},
+		{"https://users.livejournal.com/_x_/256.html", "_x_", 256},
+		{"http://www.livejournal.com/users/x/256.html", "x", 256},
+		{"https://community.livejournal.com/comm/256.html", "comm", 256},
+		{"https://syndicated.livejournal.com/feed/256.html", "feed", 256},
+		{"https://user.livejournal.com/256.html?thread=1024#t1024", "user", 256},
+		{"https://user.livejournal.com/256.html#cutid1", "user", 256},
+		{"  https://USER.livejournal.com/256.html  ", "user", 256},
+	}
+	for _, c := range valid {
+		parsed, err := ParsePostURL(c.link)
+		if err != nil {
+			t.Errorf("%s : %s", c.link, err)
+			continue
+		}
+		if (parsed.Journal != c.journal) || (parsed.DItemID != c.ditemid) {
+			t.Errorf("%s : got %s %d, expected %s %d", c.link, parsed.Journal, parsed.DItemID, c.journal, c.ditemid)
+		}
+		if (parsed.ItemID != c.ditemid / 256) || (parsed.Anum != c.ditemid % 256) {
+			t.Errorf("%s : got itemid %d anum %d", c.link, parsed.ItemID, parsed.Anum)
+		}
+	}
+
+	var invalid = []string{
+		"",
+		"https://example.com/256.html",
+		"https://user.livejournal.com.example.com/256.html",
+		"https://livejournal.com/256.html",
+		"ftp://user.livejournal.com/256.html",
+		"https://user.livejournal.com/profile",
+		"https://user.livejournal.com/",
+		"https://user.livejournal.com/255.html",
+		"https://user.livejournal.com/abc.html",
+		"https://users.livejournal.com/256.html",
+		"http://www.livejournal.com/256.html",
+		"https://users.livejournal.com/a&b=c/256.html",
+		"https://community.livejournal.com/comm/sub/256.html",
+	}
+	for _, link := range invalid {
+		if parsed, err := ParsePostURL(link); err == nil {
+			t.Errorf("%q : accepted as %+v", link, parsed)
+		}
+	}
+}
+
+func TestPostURLString(t *testing.T) {
+	var cases = map[string]string{
+		"https://some-user.livejournal.com/256.html": "https://some-user.livejournal.com/256.html",
+		"http://www.livejournal.com/users/x/256.html": "https://x.livejournal.com/256.html",
+		"https://users.livejournal.com/_x_/256.html": "https://users.livejournal.com/_x_/256.html",
+	}
+	for link, expected := range cases {
+		parsed, err := ParsePostURL(link)
+		if err != nil {
+			t.Errorf("%s : %s", link, err)
+			continue
+		}
+		if parsed.String() != expected {
+			t.Errorf("%s : got %s, expected %s", link, parsed.String(), expected)
+		}
+	}
+}
+
+func TestCanonicalJournal(t *testing.T) {
+	var cases = map[string]string{
+		"Foo": "foo",
+		"f-o-o": "f_o_o",
+		"F_O-o": "f_o_o",
+	}
+	for name, expected := range cases {
+		if CanonicalJournal(name) != expected {
+			t.Errorf("%s : got %s, expected %s", name, CanonicalJournal(name), expected)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"./archive"
+	"./images"
+	"./imgurapi"
+	"./ljapi"
+	"./rules"
+	"./worker"
+)
+
+// ljir runs a reupload task from a terminal, without the site, the queue and e-mail.
+
+var imgur imgurapi.ImgurClient
+
+type settings struct {
+	DyingHosts []string		`json:"dying_hosts"`
+	Archive string			`json:"archive"`
+	ArchiveEndpoint string	`json:"archive_endpoint"`
+}
+
+var conf settings = settings {
+	DyingHosts: worker.DyingHosts,
+}
+
+func loadConfig(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	for _, target := range []interface{}{&imgur, &conf, &images.Config} {
+		err = json.Unmarshal(content, target)
+		if err != nil {
+			return err
+		}
+	}
+	if (imgur.ClientID == "") || (imgur.ClientSecret == "") || (imgur.MashapeKey == "") {
+		return fmt.Errorf("%s : Imgur credentials are missing", filename)
+	}
+	lookup, err := archive.New(conf.Archive, conf.ArchiveEndpoint)
+	if err != nil {
+		return err
+	}
+	worker.Imgur = &imgur
+	worker.Archive = lookup
+	worker.DyingHosts = conf.DyingHosts
+	return nil
+}
+
+// console prints progress to stdout and keeps the text report.
+type console struct {
+	File *os.File
+	Done, Skipped, Failed int
+}
+
+func (c *console) Add(msg string) {
+	var line string = fmt.Sprintf("[%s] > %s\n", time.Now().Format("15:04:05"), msg)
+	fmt.Print(line)
+	fmt.Fprint(c.File, line)
+}
+
+func (c *console) Log(level slog.Level, image_url, msg string) {
+	c.Add(msg)
+}
+
+func (c *console) Post(link string) {
+	c.Add("Started reuploading for post " + link)
+}
+
+func (c *console) PostDone() {
+	c.Add(fmt.Sprintf("Images so far : %d reuploaded, %d skipped, %d failed", c.Done, c.Skipped, c.Failed))
+}
+
+func (c *console) ImageDone(image_url, new_image_url string) {
+	c.Done++
+	c.Add(image_url + " -> " + new_image_url)
+}
+
+func (c *console) ImageSkipped(image_url string) {
+	c.Skipped++
+	c.Add("Skipped " + image_url + " due to rules")
+}
+
+func (c *console) ImageFailed(image_url string, err error) {
+	c.Failed++
+	c.Add(fmt.Sprintf("%s : failed : %s", image_url, err))
+}
+
+func (c *console) RateLimited(until time.Time) {
+	c.Add("Imgur is rate-limited until " + until.Format("15:04:05"))
+}
+
+func readLines(filename string) ([]string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, line := range strings.Split(string(content), "\n") {
+		result = append(result, strings.TrimRight(line, "\r"))
+	}
+	return result, nil
+}
+
+// readPassword takes the password from LJIR_PASSWORD or asks for it with echo turned off.
+func readPassword() string {
+	if password := os.Getenv("LJIR_PASSWORD"); password != "" {
+		return password
+	}
+	fmt.Print("Password: ")
+	stty := func(arg string) {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		cmd.Run()
+	}
+	stty("-echo")
+	defer stty("echo")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	fmt.Println()
+	return strings.TrimRight(line, "\r\n")
+}
+
+func main() {
+	var task worker.Task
+	user := flag.String("user", "", "LiveJournal user")
+	links_file := flag.String("links", "", "file with links to posts, one per line")
+	rules_file := flag.String("rules", "", "file with reupload rules")
+	out := flag.String("out", "", "directory for backups and the report (default: report-<time>)")
+	config := flag.String("config", "ljir.conf", "config file with Imgur credentials")
+	flag.BoolVar(&task.Comments, "comments", false, "reupload images in own comments too")
+	flag.BoolVar(&task.Userpics, "userpics", false, "check and back up userpics")
+	flag.BoolVar(&task.Rollback, "rollback", true, "roll back posts which fail verification")
+	flag.BoolVar(&task.Processing.Transcode, "transcode", false, "transcode images before upload")
+	flag.StringVar(&task.Processing.TranscodeFormat, "transcode-format", "png", "png or jpeg")
+	flag.IntVar(&task.Processing.MaxDimension, "max-dimension", 0, "downscale images larger than this, in pixels")
+	max_size := flag.Int("max-size", 0, "recompress images larger than this, in KB")
+	flag.BoolVar(&task.Processing.StripMetadata, "strip-metadata", false, "strip EXIF and other metadata")
+	flag.Parse()
+
+	if (*user == "") || (*links_file == "") || (*rules_file == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if (task.Processing.TranscodeFormat != "png") && (task.Processing.TranscodeFormat != "jpeg") {
+		log.Fatalf("%s : unsupported transcode format", task.Processing.TranscodeFormat)
+	}
+	task.Processing.MaxSize = *max_size * 1024
+	err := loadConfig(*config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lines, err := readLines(*links_file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var failed bool = false
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parsed, err := ljapi.ParsePostURL(line)
+		if err != nil {
+			log.Print(err)
+			failed = true
+			continue
+		}
+		task.Links = append(task.Links, parsed.String())
+	}
+	task.Rules, err = readLines(*rules_file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var errs []rules.Error
+	task.RuleSet, errs = rules.Parse(task.Rules)
+	for _, e := range errs {
+		log.Print("Rules, " + e.Error())
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+	if len(task.Links) == 0 {
+		log.Fatal("No links to process")
+	}
+
+	buf := md5.Sum([]byte(readPassword()))
+	task.LJ = ljapi.LJClient{User: *user, PassHash: hex.EncodeToString(buf[:])}
+	ok, err := task.LJ.TryLogIn()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !ok {
+		log.Fatal("Wrong user or password")
+	}
+
+	if *out == "" {
+		*out = "report-" + time.Now().Format("20060102-150405")
+	}
+	var dir string = strings.TrimSuffix(*out, "/") + "/"
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+	f, err := os.Create(dir + "report.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	// progress goes to stdout, the log would only duplicate it
+	log.SetOutput(ioutil.Discard)
+	report := &console{File: f}
+	job := worker.Job{Task: task, Dir: dir, Report: report}
+	job.Run()
+	report.Add(fmt.Sprintf("Finished : %d reuploaded, %d skipped, %d failed. Report is in %s", report.Done, report.Skipped, report.Failed, dir))
+}
@@ -0,0 +1,44 @@
+// Package logging sets up structured, leveled logging shared by the site and the reuploader.
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type Config struct {
+	Level string		`json:"log_level"`
+	Format string		`json:"log_format"`
+}
+
+func parseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	err := level.UnmarshalText([]byte(strings.ToUpper(name)))
+	if err != nil {
+		return level, fmt.Errorf("%s : unknown log level", name)
+	}
+	return level, nil
+}
+
+// Setup makes the configured handler the default one. Plain log.Print calls go through it too,
+// they are logged at info level.
+func Setup(conf Config) error {
+	level, err := parseLevel(conf.Level)
+	if err != nil {
+		return err
+	}
+	var options *slog.HandlerOptions = &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch conf.Format {
+		case "", "json": handler = slog.NewJSONHandler(os.Stderr, options)
+		case "text": handler = slog.NewTextHandler(os.Stderr, options)
+		default: return fmt.Errorf("%s : unknown log format", conf.Format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
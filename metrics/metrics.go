@@ -0,0 +1,237 @@
+// Package metrics keeps counters, gauges and histograms and exposes them in Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry struct {
+	sync.Mutex
+	metrics	[]metric
+	names	map[string]bool
+}
+
+func register(name string, m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.names == nil {
+		registry.names = make(map[string]bool)
+	}
+	if registry.names[name] {
+		panic("metrics: " + name + " is registered twice")
+	}
+	registry.names[name] = true
+	registry.metrics = append(registry.metrics, m)
+}
+
+type family struct {
+	sync.Mutex
+	name	string
+	help	string
+	kind	string
+	labels	[]string
+}
+
+// key joins label values, they are checked to match label names.
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d labels, %d given", f.name, len(f.labels), len(values)))
+	}
+	return strings.Join(values, "\x00")
+}
+
+func escape(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+// selector formats labels of the series, extra is appended as is.
+func (f *family) selector(key string, extra string) string {
+	var parts []string
+	if len(f.labels) > 0 {
+		for index, value := range strings.Split(key, "\x00") {
+			parts = append(parts, fmt.Sprintf(`%s="%s"`, f.labels[index], escape(value)))
+		}
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (f *family) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter only goes up, Gauge may be set to anything.
+type Counter struct {
+	family
+	values	map[string]float64
+}
+
+type Gauge struct {
+	Counter
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{family: family{name: name, help: help, kind: "counter", labels: labels}, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		c.values[""] = 0
+	}
+	register(name, c)
+	return c
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{Counter{family: family{name: name, help: help, kind: "gauge", labels: labels}, values: make(map[string]float64)}}
+	if len(labels) == 0 {
+		g.values[""] = 0
+	}
+	register(name, g)
+	return g
+}
+
+func (c *Counter) Add(value float64, labels ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[c.key(labels)] += value
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (g *Gauge) Set(value float64, labels ...string) {
+	g.Lock()
+	defer g.Unlock()
+	g.values[g.key(labels)] = value
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	c.header(w)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.selector(key, ""), formatValue(c.values[key]))
+	}
+}
+
+type histogramSeries struct {
+	counts	[]uint64
+	sum		float64
+	count	uint64
+}
+
+type Histogram struct {
+	family
+	buckets	[]float64
+	series	map[string]*histogramSeries
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{family: family{name: name, help: help, kind: "histogram", labels: labels}, buckets: buckets, series: make(map[string]*histogramSeries)}
+	register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labels ...string) {
+	h.Lock()
+	defer h.Unlock()
+	key := h.key(labels)
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for index, bound := range h.buckets {
+		if value <= bound {
+			series.counts[index]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	h.header(w)
+	var keys []string
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := h.series[key]
+		for index, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.selector(key, `le="` + formatValue(bound) + `"`), series.counts[index])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.selector(key, `le="+Inf"`), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.selector(key, ""), formatValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.selector(key, ""), series.count)
+	}
+}
+
+// WriteText writes all registered metrics.
+func WriteText(w io.Writer) {
+	registry.Lock()
+	metrics := registry.metrics
+	registry.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func Handler(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	WriteText(response)
+}
+
+// Serve exposes /metrics on its own address, so that it can be kept away from the public.
+// Empty address disables it.
+func Serve(address string) {
+	if address == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", Handler)
+	go func() {
+		slog.Info("Serving metrics", "address", address)
+		err := http.ListenAndServe(address, mux)
+		slog.Error("Metrics server stopped", "address", address, "error", err)
+	}()
+}
@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// The reuploader publishes its own state for operators, next to statuses of tasks.
+
+const DAEMON_FILE = STATUS_DIR + "reuploader.json"
+const MAX_RECENT_ERRORS = 50
+
+type RecentError struct {
+	Time	time.Time	`json:"time"`
+	Task	string		`json:"task,omitempty"`
+	Message	string		`json:"message"`
+}
+
+type Daemon struct {
+	Updated			time.Time		`json:"updated"`
+	Task			string			`json:"task,omitempty"`
+	ImgurLocked		bool			`json:"imgur_locked"`
+	ImgurResetTime	int				`json:"imgur_reset_time"`
+	ImgurRemaining	int				`json:"imgur_remaining"`
+	Errors			[]RecentError	`json:"errors"`
+}
+
+func LoadDaemon() (Daemon, error) {
+	content, err := ioutil.ReadFile(DAEMON_FILE)
+	if err != nil {
+		return Daemon{}, err
+	}
+	var result Daemon
+	err = json.Unmarshal(content, &result)
+	return result, err
+}
+
+func (d *Daemon) Save() error {
+	d.Updated = time.Now()
+	content, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WriteFile(DAEMON_FILE, content)
+}
+
+// AddError remembers the error, only the most recent ones are kept.
+func (d *Daemon) AddError(task, msg string) {
+	d.Errors = append(d.Errors, RecentError{Time: time.Now(), Task: task, Message: msg})
+	if len(d.Errors) > MAX_RECENT_ERRORS {
+		d.Errors = d.Errors[len(d.Errors) - MAX_RECENT_ERRORS:]
+	}
+}
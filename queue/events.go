@@ -0,0 +1,191 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Progress of a running task is published as a stream of events, appended one JSON per line
+// to the events file of the task. The front-end tails the file, the text report is made from it,
+// and the same events are written to the log of the reuploader.
+
+type EventKind string
+
+const (
+	EventLog EventKind = "log"
+	EventPostStarted EventKind = "post_started"
+	EventPostDone EventKind = "post_done"
+	EventImageUploaded EventKind = "image_uploaded"
+	EventImageSkipped EventKind = "image_skipped"
+	EventImageFailed EventKind = "image_failed"
+	EventRateLimited EventKind = "rate_limited"
+	EventFinished EventKind = "finished"
+)
+
+type Event struct {
+	Seq			int			`json:"seq"`
+	Time		time.Time	`json:"time"`
+	Kind		EventKind	`json:"kind"`
+	Level		string		`json:"level,omitempty"`
+	Post		string		`json:"post,omitempty"`
+	Image		string		`json:"image,omitempty"`
+	NewImage	string		`json:"new_image,omitempty"`
+	Until		int64		`json:"until,omitempty"`
+	Message		string		`json:"message"`
+}
+
+// String formats the event as a line of the text report.
+func (e Event) String() string {
+	return fmt.Sprintf("[%s] > %s\n", e.Time.Format("15:04:05"), e.Message)
+}
+
+// LogLevel is the level of the event in the log, plain log events carry their own.
+func (e Event) LogLevel() slog.Level {
+	var level slog.Level
+	if (e.Level != "") && (level.UnmarshalText([]byte(e.Level)) == nil) {
+		return level
+	}
+	switch e.Kind {
+		case EventImageFailed: return slog.LevelError
+		case EventRateLimited: return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// Log writes the event to the logger, which is expected to carry the task and the user already.
+func (e Event) Log(logger *slog.Logger) {
+	var attrs []any = []any{"kind", string(e.Kind), "seq", e.Seq}
+	if e.Post != "" {
+		attrs = append(attrs, "post", e.Post)
+	}
+	if e.Image != "" {
+		attrs = append(attrs, "image", e.Image)
+	}
+	if e.NewImage != "" {
+		attrs = append(attrs, "new_image", e.NewImage)
+	}
+	if e.Until != 0 {
+		attrs = append(attrs, "until", time.Unix(e.Until, 0))
+	}
+	logger.Log(context.Background(), e.LogLevel(), e.Message, attrs...)
+}
+
+func EventFile(id string) string {
+	return ReportDir(id) + "events.jsonl"
+}
+
+type EventWriter struct {
+	file	*os.File
+	seq		int
+}
+
+// AppendEvents continues the event stream of the task, starting it if there is none yet.
+// Numbering goes on after the last event, including the events of a previous run.
+func AppendEvents(id string) (*EventWriter, error) {
+	events, _ := ReadEvents(id, 0)
+	f, err := os.OpenFile(EventFile(id), os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	os.Chown(EventFile(id), UserID, GroupID)
+	var writer *EventWriter = &EventWriter{file: f}
+	if len(events) > 0 {
+		writer.seq = events[len(events) - 1].Seq
+	}
+	return writer, nil
+}
+
+// Publish numbers and timestamps the event and appends it to the stream.
+func (w *EventWriter) Publish(e Event) (Event, error) {
+	w.seq++
+	e.Seq = w.seq
+	e.Time = time.Now()
+	content, err := json.Marshal(e)
+	if err != nil {
+		return e, err
+	}
+	_, err = w.file.Write(append(content, '\n'))
+	return e, err
+}
+
+func (w *EventWriter) Close() error {
+	return w.file.Close()
+}
+
+// ReadEvents returns events of the task with sequence numbers greater than after.
+func ReadEvents(id string, after int) ([]Event, error) {
+	return NewEventReader(id).Read(after)
+}
+
+// EventReader follows the event stream of a task, each Read parses only what was appended
+// since the previous one.
+type EventReader struct {
+	id		string
+	offset	int64
+}
+
+func NewEventReader(id string) *EventReader {
+	return &EventReader{id: id}
+}
+
+// Read returns new events with sequence numbers greater than after.
+func (r *EventReader) Read(after int) ([]Event, error) {
+	f, err := os.Open(EventFile(r.id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// the stream was started over when the task was requeued
+	if info.Size() < r.offset {
+		r.offset = 0
+	}
+	_, err = f.Seek(r.offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	var result []Event
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		// the last line may be half-written yet, it is read again next time
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		r.offset += int64(len(line))
+		var e Event
+		if (json.Unmarshal(line, &e) == nil) && (e.Seq > after) {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+// WriteReport renders events of the task into the text report.
+func WriteReport(id string) error {
+	events, err := ReadEvents(id, 0)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(ReportLog(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, e := range events {
+		fmt.Fprint(f, e.String())
+	}
+	return nil
+}
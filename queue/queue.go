@@ -0,0 +1,634 @@
+// Package queue keeps queued tasks, their statuses and reports on disk, so that
+// the front-end and the reuploader can share them.
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const TASKS_DIR = "tasks/"
+const STATUS_DIR = "status/"
+const REPORTS_DIR = "reports/"
+
+type State string
+
+const (
+	Queued State = "queued"
+	Running State = "running"
+	Paused State = "paused"
+	Done State = "done"
+	Failed State = "failed"
+	Cancelled State = "cancelled"
+)
+
+var ErrFinished = errors.New("Task is already finished")
+var ErrNotRunning = errors.New("Task is not running")
+var ErrNotPaused = errors.New("Task is not paused")
+var ErrNotQueued = errors.New("Task is not waiting in the queue")
+var ErrActive = errors.New("Task is still in the queue")
+var ErrNotRetired = errors.New("Task file with credentials is gone, the owner has to submit the task again")
+var ErrCancelled = errors.New("Task was cancelled")
+
+// Control is what the user wants the reuploader to do with a running task, it is kept in a file next to the status.
+type Control string
+
+const (
+	ControlNone Control = ""
+	ControlPause Control = "pause"
+	ControlCancel Control = "cancel"
+)
+
+// Status is what is known about the task while it waits and runs.
+type Status struct {
+	ID				string		`json:"id"`
+	User			string		`json:"user"`
+	Email			string		`json:"email"`
+	State			State		`json:"state"`
+	Error			string		`json:"error,omitempty"`
+	Submitted		time.Time	`json:"submitted"`
+	Priority		int			`json:"priority"`
+	NotBefore		time.Time	`json:"not_before,omitempty"`
+	Started			time.Time	`json:"started,omitempty"`
+	Finished		time.Time	`json:"finished,omitempty"`
+	LastRun			time.Time	`json:"last_run,omitempty"`
+	RunTime			time.Duration	`json:"run_time"`
+	Posts			int			`json:"posts"`
+	PostsDone		int			`json:"posts_done"`
+	NextPost		int			`json:"next_post"`
+	CurrentPost		string		`json:"current_post"`
+	ImagesDone		int			`json:"images_done"`
+	ImagesSkipped	int			`json:"images_skipped"`
+	ImagesFailed	int			`json:"images_failed"`
+}
+
+// Owner of files created in queue directories, so that both programs can access them.
+var UserID, GroupID int = os.Getuid(), os.Getgid()
+
+// SlicePosts is how many posts of a task run before other tasks get their turn, 0 means no slicing.
+var SlicePosts int = 20
+
+// Posts are assumed to take this long until some tasks are finished.
+const DEFAULT_POST_TIME = 20 * time.Second
+
+var idPattern = regexp.MustCompile(`^[0-9]+-[A-Z0-9]{8}$`)
+
+// NewID returns an unguessable task id, which starts with submission time so ids sort in queue order.
+func NewID() string {
+	const ALPHABET = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	var res string = strconv.Itoa(int(time.Now().Unix())) + "-"
+	for i := 0; i < 8; i++ {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(ALPHABET))))
+		res = res + string(ALPHABET[n.Int64()])
+	}
+	return res
+}
+
+// ValidID tells whenever id is safe to use in file names.
+func ValidID(id string) bool {
+	return idPattern.MatchString(id)
+}
+
+// Init creates queue directories.
+func Init() {
+	for _, dir := range []string{TASKS_DIR, STATUS_DIR, REPORTS_DIR} {
+		os.MkdirAll(dir, 0770)
+		os.Chown(dir, UserID, GroupID)
+	}
+}
+
+func TaskFile(id string) string {
+	return TASKS_DIR + id
+}
+
+// RetiredTaskFile keeps the task after it has left the queue, so that it can be requeued.
+func RetiredTaskFile(id string) string {
+	return STATUS_DIR + id + ".task"
+}
+
+func ReportDir(id string) string {
+	return REPORTS_DIR + id + "/"
+}
+
+func ReportLog(id string) string {
+	return ReportDir(id) + "report.txt"
+}
+
+func ReportArchive(id string) string {
+	return REPORTS_DIR + id + ".tar.gz"
+}
+
+// WriteFile atomically replaces file contents and makes it accessible to the other program.
+func WriteFile(filename string, content []byte) error {
+	tmp := filename + ".tmp"
+	err := ioutil.WriteFile(tmp, content, 0660)
+	if err != nil {
+		return err
+	}
+	os.Chown(tmp, UserID, GroupID)
+	os.Chmod(tmp, 0660)
+	return os.Rename(tmp, filename)
+}
+
+func LoadStatus(id string) (Status, error) {
+	content, err := ioutil.ReadFile(STATUS_DIR + id + ".json")
+	if err != nil {
+		return Status{}, err
+	}
+	var result Status
+	err = json.Unmarshal(content, &result)
+	return result, err
+}
+
+func (s *Status) Save() error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return WriteFile(STATUS_DIR + s.ID + ".json", content)
+}
+
+// Statuses returns statuses of all known tasks, the most recent first.
+func Statuses() ([]Status, error) {
+	files, err := ioutil.ReadDir(STATUS_DIR)
+	if err != nil {
+		return nil, err
+	}
+	var result []Status
+	for _, file := range files {
+		name := file.Name()
+		if (len(name) < 5) || (name[len(name)-5:] != ".json") || !ValidID(name[:len(name)-5]) {
+			continue
+		}
+		status, err := LoadStatus(name[:len(name)-5])
+		if err != nil {
+			continue
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Submitted.After(result[j].Submitted)
+	})
+	return result, nil
+}
+
+// Pending returns ids of all queued task files, in no particular order, Order tells which runs next.
+func Pending() ([]string, error) {
+	files, err := ioutil.ReadDir(TASKS_DIR)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, file := range files {
+		if ValidID(file.Name()) {
+			result = append(result, file.Name())
+		}
+	}
+	return result, nil
+}
+
+// Order returns ids of tasks ready to run, paused ones and those waiting for their start time are left out.
+// Cancelled tasks go first, then higher priority, then users served least recently, their tasks which ran
+// least recently and older tasks.
+func Order() ([]string, error) {
+	pending, err := Pending()
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := Statuses()
+	if err != nil {
+		return nil, err
+	}
+	var tasks map[string]Status = make(map[string]Status)
+	var served map[string]time.Time = make(map[string]time.Time)
+	for _, status := range statuses {
+		tasks[status.ID] = status
+		if status.LastRun.After(served[status.User]) {
+			served[status.User] = status.LastRun
+		}
+	}
+	var now time.Time = time.Now()
+	var ready []string
+	var cancelled map[string]bool = make(map[string]bool)
+	for _, id := range pending {
+		cancelled[id] = GetControl(id) == ControlCancel
+		if cancelled[id] || (!tasks[id].NotBefore.After(now) && (tasks[id].State != Paused)) {
+			ready = append(ready, id)
+		}
+	}
+	pending = ready
+	sort.SliceStable(pending, func(i, j int) bool {
+		a, b := tasks[pending[i]], tasks[pending[j]]
+		if cancelled[pending[i]] != cancelled[pending[j]] {
+			return cancelled[pending[i]]
+		}
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if !served[a.User].Equal(served[b.User]) {
+			return served[a.User].Before(served[b.User])
+		}
+		if !a.LastRun.Equal(b.LastRun) {
+			return a.LastRun.Before(b.LastRun)
+		}
+		return pending[i] < pending[j]
+	})
+	return pending, nil
+}
+
+// Position returns how many tasks are ahead of id in the queue, -1 if it isn't queued.
+func Position(id string) int {
+	pending, err := Order()
+	if err != nil {
+		return -1
+	}
+	for index, pending_id := range pending {
+		if pending_id == id {
+			return index
+		}
+	}
+	return -1
+}
+
+func controlFile(id string) string {
+	return STATUS_DIR + id + ".control"
+}
+
+func GetControl(id string) Control {
+	content, err := ioutil.ReadFile(controlFile(id))
+	if err != nil {
+		return ControlNone
+	}
+	return Control(strings.TrimSpace(string(content)))
+}
+
+func SetControl(id string, control Control) error {
+	if control == ControlNone {
+		err := os.Remove(controlFile(id))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return WriteFile(controlFile(id), []byte(control))
+}
+
+// lock serializes changes of the task state between the site and the reuploader, those are
+// different processes, so the lock is a file lock next to the status.
+func lock(id string) (func(), error) {
+	var filename string = STATUS_DIR + id + ".lock"
+	f, err := os.OpenFile(filename, os.O_RDWR | os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	os.Chown(filename, UserID, GroupID)
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// Start marks a queued task as running. A task cancelled after the reuploader has picked it
+// is refused with ErrCancelled, the check and the change are done under the lock Cancel takes.
+func Start(id string) (Status, error) {
+	unlock, err := lock(id)
+	if err != nil {
+		return Status{}, err
+	}
+	defer unlock()
+	status, err := LoadStatus(id)
+	if err != nil {
+		status = Status{ID: id, Submitted: time.Now()}
+	}
+	if _, err := os.Stat(TaskFile(id)); (status.State == Cancelled) || (err != nil) {
+		return status, ErrCancelled
+	}
+	status.State = Running
+	status.Error = ""
+	status.LastRun = time.Now()
+	return status, status.Save()
+}
+
+// Cancel takes a queued task out of the queue, a running one is asked to stop after the current image.
+// A queued task which has run already is cancelled by the reuploader too, so that the user gets
+// the report with what was done.
+func Cancel(id string) error {
+	unlock, err := lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	status, err := LoadStatus(id)
+	if err != nil {
+		return err
+	}
+	switch status.State {
+		case Queued:
+			if !status.Started.IsZero() {
+				return SetControl(id, ControlCancel)
+			}
+			err = Retire(id)
+			if err != nil {
+				return err
+			}
+			status.State = Cancelled
+			status.Finished = time.Now()
+			return status.Save()
+		case Running, Paused:
+			return SetControl(id, ControlCancel)
+	}
+	return ErrFinished
+}
+
+// Pause asks the reuploader to hold a running task after the current image.
+func Pause(id string) error {
+	unlock, err := lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	status, err := LoadStatus(id)
+	if err != nil {
+		return err
+	}
+	if status.State != Running {
+		return ErrNotRunning
+	}
+	return SetControl(id, ControlPause)
+}
+
+// Resume puts a paused task back to the queue, it goes on from the post it was paused at.
+func Resume(id string) error {
+	unlock, err := lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	status, err := LoadStatus(id)
+	if err != nil {
+		return err
+	}
+	if (status.State != Paused) && (GetControl(id) != ControlPause) {
+		return ErrNotPaused
+	}
+	err = SetControl(id, ControlNone)
+	if (err != nil) || (status.State != Paused) {
+		return err
+	}
+	status.State = Queued
+	return status.Save()
+}
+
+// Hold saves status of a task the reuploader has stopped on pause. It stays Paused, and out of
+// the queue, unless it was resumed while the job was stopping.
+func Hold(status Status) (Status, error) {
+	unlock, err := lock(status.ID)
+	if err != nil {
+		return status, err
+	}
+	defer unlock()
+	status.State = Queued
+	if GetControl(status.ID) == ControlPause {
+		status.State = Paused
+	}
+	return status, status.Save()
+}
+
+// SetPriority moves a queued task up or down the queue. Status of a running task belongs to
+// the reuploader, which would overwrite the change, so the priority of one is changed
+// while it waits between slices.
+func SetPriority(id string, priority int) error {
+	unlock, err := lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	status, err := LoadStatus(id)
+	if err != nil {
+		return err
+	}
+	if (status.State == Running) || (status.State == Paused) {
+		return ErrNotQueued
+	}
+	if status.State != Queued {
+		return ErrFinished
+	}
+	status.Priority = priority
+	return status.Save()
+}
+
+// sliceTime estimates how long the task keeps the reuploader busy during its next turn.
+func (s *Status) sliceTime(per_post time.Duration) time.Duration {
+	var posts int = s.Posts - s.NextPost
+	if (SlicePosts > 0) && (posts > SlicePosts) {
+		posts = SlicePosts
+	}
+	return time.Duration(posts) * per_post
+}
+
+// ExpectedStart estimates when a queued task will start, from the average time of posts in finished tasks.
+// Their time is that of slices they ran, not the time between start and finish, which includes waiting.
+func ExpectedStart(id string) (time.Time, error) {
+	status, err := LoadStatus(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	statuses, err := Statuses()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var total time.Duration = 0
+	var posts int = 0
+	for _, other := range statuses {
+		if (other.State == Done) && (other.PostsDone > 0) && (other.RunTime > 0) {
+			total += other.RunTime
+			posts += other.PostsDone
+		}
+	}
+	var per_post time.Duration = DEFAULT_POST_TIME
+	if posts > 0 {
+		per_post = total / time.Duration(posts)
+	}
+
+	var wait time.Duration = 0
+	var known map[string]Status = make(map[string]Status)
+	var counted map[string]bool = make(map[string]bool)
+	for _, other := range statuses {
+		known[other.ID] = other
+		if (other.State == Running) && (other.ID != id) {
+			wait += other.sliceTime(per_post)
+			counted[other.ID] = true
+		}
+	}
+	order, err := Order()
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, other_id := range order {
+		if other_id == id {
+			break
+		}
+		// the running task is still in the queue, its slice is counted already
+		if counted[other_id] {
+			continue
+		}
+		other := known[other_id]
+		wait += other.sliceTime(per_post)
+	}
+	var start time.Time = time.Now().Add(wait)
+	if status.NotBefore.After(start) {
+		start = status.NotBefore
+	}
+	return start, nil
+}
+
+// Retire takes the task file out of the queue.
+func Retire(id string) error {
+	err := os.Rename(TaskFile(id), RetiredTaskFile(id))
+	if err != nil {
+		return err
+	}
+	// retention is counted from now, not from the submission
+	var now time.Time = time.Now()
+	return os.Chtimes(RetiredTaskFile(id), now, now)
+}
+
+// RemoveRetired deletes retired task files, and LJ credentials sealed in them, which were retired
+// more than age ago. Such tasks can't be requeued anymore.
+func RemoveRetired(age time.Duration) error {
+	files, err := ioutil.ReadDir(STATUS_DIR)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		var id string = strings.TrimSuffix(file.Name(), ".task")
+		if (id != file.Name()) && ValidID(id) && (time.Since(file.ModTime()) > age) {
+			err = removeRetired(id, age)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeRetired checks the age again under the lock, the task may have been requeued meanwhile.
+func removeRetired(id string, age time.Duration) error {
+	unlock, err := lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	info, err := os.Stat(RetiredTaskFile(id))
+	if os.IsNotExist(err) || ((err == nil) && (time.Since(info.ModTime()) <= age)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(RetiredTaskFile(id))
+}
+
+// RemoveFinished deletes statuses, reports and backups of tasks which finished more than age ago.
+func RemoveFinished(age time.Duration) error {
+	statuses, err := Statuses()
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		if status.Finished.IsZero() || (time.Since(status.Finished) <= age) {
+			continue
+		}
+		err = Delete(status.ID)
+		if (err != nil) && (err != ErrActive) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Requeue puts a finished, failed or cancelled task back to the queue, it starts from the beginning
+// with a new report.
+func Requeue(id string) error {
+	unlock, err := lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	status, err := LoadStatus(id)
+	if err != nil {
+		return err
+	}
+	if (status.State == Queued) || (status.State == Running) || (status.State == Paused) {
+		return ErrActive
+	}
+	if _, err := os.Stat(RetiredTaskFile(id)); err != nil {
+		return ErrNotRetired
+	}
+	SetControl(id, ControlNone)
+	err = os.Rename(RetiredTaskFile(id), TaskFile(id))
+	if err != nil {
+		return err
+	}
+	// backups are kept, they hold the original content of posts
+	os.Remove(ReportArchive(id))
+	os.Remove(ReportLog(id))
+	os.Remove(EventFile(id))
+	status.State = Queued
+	status.Error = ""
+	status.Started, status.Finished = time.Time{}, time.Time{}
+	status.RunTime = 0
+	status.NextPost, status.PostsDone = 0, 0
+	status.ImagesDone, status.ImagesSkipped, status.ImagesFailed = 0, 0, 0
+	return status.Save()
+}
+
+// Delete removes every trace of a task which isn't in the queue.
+func Delete(id string) error {
+	unlock, err := lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	status, err := LoadStatus(id)
+	if err != nil {
+		return err
+	}
+	if (status.State == Queued) || (status.State == Running) || (status.State == Paused) {
+		return ErrActive
+	}
+	os.Remove(RetiredTaskFile(id))
+	os.Remove(controlFile(id))
+	os.Remove(STATUS_DIR + id + ".lock")
+	os.RemoveAll(ReportDir(id))
+	os.Remove(ReportArchive(id))
+	return os.Remove(STATUS_DIR + id + ".json")
+}
+
+// ArchiveReport packs report directory of the task for download and email.
+func ArchiveReport(id string) error {
+	cmd := exec.Command("tar", "-zcf", ReportArchive(id), "-C", REPORTS_DIR, id)
+	err := cmd.Run()
+	if err != nil {
+		return err
+	}
+	os.Chown(ReportArchive(id), UserID, GroupID)
+	os.Chmod(ReportArchive(id), 0660)
+	return nil
+}
@@ -3,19 +3,21 @@ package main
 import (
 	"time"
 	"os"
-	"log"
+	"log/slog"
 	"io/ioutil"
-	"./ljapi"
 	"./imgurapi"
 	"./sender"
+	"./secret"
+	"./rules"
+	"./images"
+	"./archive"
+	"./worker"
+	"./queue"
+	"./metrics"
+	"./logging"
 	"fmt"
-	"net/url"
-	"net/http"
 	"encoding/json"
-	"strings"
-	"strconv"
 	"path"
-	"errors"
 )
 
 var imgur imgurapi.ImgurClient = imgurapi.ImgurClient {
@@ -32,339 +34,457 @@ var mail sender.SMTPSettings = sender.SMTPSettings {
 	SmtpServer: "",
 }
 
-type task struct {
-	LJ ljapi.LJClient	`json:"lj_client"`
-	Email string			`json:"email"`
-	Links []string		`json:"links"`
-	Rules []string		`json:"rules"`
-	Filename string
+type settings struct {
+	TaskKey string			`json:"task_key"`
+	DyingHosts []string	`json:"dying_hosts"`
+	Archive string			`json:"archive"`
+	ArchiveEndpoint string	`json:"archive_endpoint"`
+	GroupID int				`json:"gid"`
+	UserID int				`json:"uid"`
+	SlicePosts int			`json:"slice_posts"`
+	MetricsAddress string	`json:"reuploader_metrics_address"`
+	RetiredTaskHours int	`json:"retired_task_hours"`
+	ReportRetentionDays int	`json:"report_retention_days"`
 }
 
-type image struct {
-	URL, Domain string
-	Size int
+var logConfig logging.Config
+
+var conf settings = settings {
+	TaskKey: "ljir.key",
+	DyingHosts: []string{"photobucket.com", "tinypic.com", "imageshack.us", "radikal.ru", "fotki.yandex.ru"},
+	GroupID: os.Getgid(),
+	UserID: os.Getuid(),
+	SlicePosts: queue.SlicePosts,
+	RetiredTaskHours: 48,
+	ReportRetentionDays: 30,
+}
+
+var taskKey []byte
+
+var (
+	tasksFinished = metrics.NewCounter("ljir_tasks_finished_total", "Tasks which left the reuploader, by state.", "state")
+	emailsSent = metrics.NewCounter("ljir_emails_sent_total", "Report e-mails, by result.", "result")
+	imgurLocked = metrics.NewGauge("ljir_imgur_locked", "Whenever Imgur upload limit is reached.")
+	imgurRemaining = metrics.NewGauge("ljir_imgur_remaining_uploads", "Uploads left until the Imgur limit, as last reported by Imgur.")
+)
+
+var archiveLookup archive.Lookup
+
+type task struct {
+	worker.Task
+	Sealed string		`json:"lj_sealed"`
+	Filename string
 }
 
 func loadConfig(filename string) bool {
 	content, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Print("Failed to read config file.")
-		log.Print(err)
+		slog.Error("Failed to read config file", "error", err)
 		return false
 	}
 	err = json.Unmarshal(content, &imgur)
 	if err != nil {
-		log.Print("Failed to parse config file.")
-		log.Print(err)
+		slog.Error("Failed to parse config file", "error", err)
 		return false
 	}
 	err = json.Unmarshal(content, &mail)
 	if err != nil {
-		log.Print("Failed to parse config file.")
-		log.Print(err)
+		slog.Error("Failed to parse config file", "error", err)
+		return false
+	}
+	err = json.Unmarshal(content, &conf)
+	if err != nil {
+		slog.Error("Failed to parse config file", "error", err)
+		return false
+	}
+	err = json.Unmarshal(content, &images.Config)
+	if err != nil {
+		slog.Error("Failed to parse config file", "error", err)
+		return false
+	}
+	err = json.Unmarshal(content, &logConfig)
+	if err == nil {
+		err = logging.Setup(logConfig)
+	}
+	if err != nil {
+		slog.Error("Invalid config file", "error", err)
 		return false
 	}
 	if (imgur.ClientID == "") || (imgur.ClientSecret == "") || (imgur.MashapeKey == "") {
-		log.Print("Invalid config file.")
+		slog.Error("Invalid config file, Imgur credentials are required")
 		return false
 	}
 	if (mail.SmtpUsername == "") || (mail.SmtpPassword == "") || (mail.SmtpServer == "") {
-		log.Print("Invalid config file.")
+		slog.Error("Invalid config file, SMTP settings are required")
+		return false
+	}
+	taskKey, err = secret.LoadKey(conf.TaskKey)
+	if err != nil {
+		slog.Error("Failed to load task key", "error", err)
+		return false
+	}
+	archiveLookup, err = archive.New(conf.Archive, conf.ArchiveEndpoint)
+	if err != nil {
+		slog.Error("Invalid config file", "error", err)
 		return false
 	}
-	log.Print("Config file successfuly loaded.")
+	worker.Imgur = &imgur
+	worker.Archive = archiveLookup
+	worker.DyingHosts = conf.DyingHosts
+	queue.SlicePosts = conf.SlicePosts
+	queue.UserID = conf.UserID
+	queue.GroupID = conf.GroupID
+	slog.Info("Config file successfuly loaded")
 	return true
 }
 
-func (i *image) GetImageInfo() error {
-	u, err := url.Parse(i.URL)
-	if (err != nil) {
-		return err
+// reporter publishes progress of the running task as events, which are streamed to the site,
+// written to the log and later rendered into the text report.
+type reporter struct {
+	Events *queue.EventWriter
+	Dir string
+	Status queue.Status
+	Logger *slog.Logger
+}
+
+// Begin marks the task as running, false means it was cancelled meanwhile and must not run.
+// The report directory is kept, a task put back to the queue by the Imgur lock before its first
+// slice was over already has backups there.
+func (r *reporter) Begin(id, user string) bool {
+	r.Dir = queue.ReportDir(id)
+	r.Logger = slog.With("task", id, "user", user)
+	status, err := queue.Start(id)
+	if err == queue.ErrCancelled {
+		r.Logger.Info("Task was cancelled before it started")
+		return false
 	}
-	i.Domain = u.Host
-	if (err != nil) {
-		return err
+	if err != nil {
+		r.Logger.Error("Failed to mark task as running", "error", err)
 	}
-	head, err := http.Head(i.URL)
-	if (err != nil) {
-		return err
+	status.User = user
+	os.Mkdir(r.Dir, 0770)
+	os.Chown(r.Dir, queue.UserID, queue.GroupID)
+	// events are numbered on, the site keeps tailing the stream from the last event it has seen
+	events, err := queue.AppendEvents(id)
+	if err != nil {
+		r.Logger.Error("Failed to open events", "error", err)
 	}
-	if (head.StatusCode != http.StatusOK) {
-		return errors.New("Unknown error : " + head.Status)
+	r.Events = events
+	if status.Started.IsZero() {
+		status.Started = time.Now()
 	}
-	i.Size, err = strconv.Atoi(head.Header.Get("Content-Length"));
-	if (err != nil) {
-		return err
+	if status.NextPost == 0 {
+		status.PostsDone, status.ImagesDone, status.ImagesSkipped, status.ImagesFailed = 0, 0, 0, 0
 	}
-	return nil
+	r.Status = status
+	r.Save()
+	return true
 }
 
-func (i *image) CheckImage(rules []string) bool {
-	var rules_map map[string][]string = make(map[string][]string)
-	for _, rule := range rules {
-		entry := strings.Split(rule, " ")
-		rules_map[entry[0]] = entry[1:]
+// Publish appends the event to the stream of the task and writes the same event to the log.
+func (r *reporter) Publish(e queue.Event) {
+	if (e.Post == "") && (e.Kind != queue.EventFinished) {
+		e.Post = r.Status.CurrentPost
 	}
-	if (rules_map["MORETHAN"] != nil) {
-		if size, err := strconv.Atoi(rules_map["MORETHAN"][0]); (err != nil || i.Size <= size) {
-			return false
-		}
+	if e.Level == "" {
+		e.Level = e.LogLevel().String()
 	}
-	if (rules_map["LESSTHAN"] != nil) {
-		if size, err := strconv.Atoi(rules_map["LESSTHAN"][0]); (err != nil || i.Size <= size) {
-			return false
+	if r.Events != nil {
+		var err error
+		e, err = r.Events.Publish(e)
+		if err != nil {
+			r.Logger.Error("Failed to publish event", "error", err)
 		}
 	}
-	if (rules_map["EXCLUDE"] != nil) {
-		for _, domain := range rules_map["EXCLUDE"] {
-			if (i.Domain == domain) {
-				return false
-			}
-		}
+	e.Log(r.Logger)
+}
+
+func (r *reporter) Log(level slog.Level, image_url, msg string) {
+	if level >= slog.LevelError {
+		daemon.AddError(r.Status.ID, msg)
 	}
-	if (rules_map["INCLUDE"] != nil) {
-		var found bool = false
-		for _, domain := range rules_map["INCLUDE"] {
-			if (domain == "*" || i.Domain == domain) {
-				found = true
-				break
-			}
-		}
-		if (!found) {
-			return false
-		}
+	r.Publish(queue.Event{Kind: queue.EventLog, Level: level.String(), Image: image_url, Message: msg})
+}
+
+// Save persists status of the task and, along with it, state of the reuploader.
+func (r *reporter) Save() {
+	err := r.Status.Save()
+	if err != nil {
+		r.Logger.Error("Failed to save status", "error", err)
 	}
-	return true
+	daemon.Task = r.Status.ID
+	saveDaemon()
 }
 
-type reporter struct {
-	File *os.File
+func (r *reporter) Post(link string) {
+	r.Status.CurrentPost = link
+	r.Save()
+	r.Publish(queue.Event{Kind: queue.EventPostStarted, Message: "Started reuploading for post " + link})
 }
 
-func (r *reporter) Begin() {
-	r.File, _ = os.Create("report/report.txt")
+// PostDone moves the task past the post, a task put back to the queue for any reason, or left
+// after a crash, goes on from the next one instead of uploading the same images again.
+func (r *reporter) PostDone() {
+	r.Status.PostsDone++
+	r.Status.NextPost++
+	r.Save()
+	r.Publish(queue.Event{Kind: queue.EventPostDone, Message: "Finished post " + r.Status.CurrentPost})
 }
 
-func (r *reporter) Add(msg string) {
-	fmt.Fprintf(r.File, "[%s] > %s", time.Now().Format("15:04:05"), msg)
+func (r *reporter) ImageDone(image_url, new_image_url string) {
+	r.Status.ImagesDone++
+	r.Save()
+	r.Publish(queue.Event{Kind: queue.EventImageUploaded, Image: image_url, NewImage: new_image_url, Message: image_url + " -> " + new_image_url})
 }
 
-func (r *reporter) Finish() {
-	r.File.Close();
+func (r *reporter) ImageSkipped(image_url string) {
+	r.Status.ImagesSkipped++
+	r.Save()
+	r.Publish(queue.Event{Kind: queue.EventImageSkipped, Image: image_url, Message: "Skipped " + image_url + " due to rules"})
 }
 
-var main_report reporter
+func (r *reporter) ImageFailed(image_url string, err error) {
+	daemon.AddError(r.Status.ID, fmt.Sprintf("%s : failed : %s", image_url, err))
+	r.Status.ImagesFailed++
+	r.Save()
+	r.Publish(queue.Event{Kind: queue.EventImageFailed, Image: image_url, Message: fmt.Sprintf("%s : failed : %s", image_url, err)})
+}
 
-func loadTask(filename string) task {
-	content, err := ioutil.ReadFile(filename)
-	if err != nil {
-		log.Printf("Failed to load task %s", filename)
-		log.Print(err)
-		os.Remove(filename)
-		return task{}
+func (r *reporter) RateLimited(until time.Time) {
+	saveDaemon()
+	r.Publish(queue.Event{Kind: queue.EventRateLimited, Until: until.Unix(), Message: "Imgur is rate-limited until " + until.Format("15:04:05")})
+}
+
+func (r *reporter) Finish() {
+	if r.Events == nil {
+		return
 	}
-	var result task
-	err = json.Unmarshal(content, &result)
+	r.Events.Close()
+	r.Events = nil
+	err := queue.WriteReport(r.Status.ID)
 	if err != nil {
-		log.Printf("Failed to parse task %s", filename)
-		log.Print(err)
-		os.Remove(filename)
-		return task{}
+		r.Logger.Error("Failed to write report", "error", err)
 	}
-	result.Filename = filename
-	log.Printf("Loaded task %s", filename)
-	return result
 }
 
-func boolToInt(b bool) int {
-	if b {
-		return 1
-	} else {
-		return 0
+func (r *reporter) End(state queue.State, msg string) {
+	// time of the slice, waiting in the queue isn't counted
+	r.Status.RunTime += time.Since(r.Status.LastRun)
+	r.Status.State = state
+	r.Status.Error = msg
+	r.Status.CurrentPost = ""
+	daemon.Task = ""
+	if state == queue.Paused {
+		var err error
+		r.Status, err = queue.Hold(r.Status)
+		if err != nil {
+			r.Logger.Error("Failed to save status", "error", err)
+		}
+		saveDaemon()
+		return
 	}
+	if state != queue.Queued {
+		r.Status.Finished = time.Now()
+	}
+	r.Save()
 }
 
-func processPost(post ljapi.LJPost, rules []string) (ljapi.LJPost, error) {
-	var tokens = [...]string {"<", "img", "src=\"", "\""}
-	var token_index int = 0
-	var url_begin, url_end int = 0,0
+var main_report reporter = reporter{Logger: slog.Default()}
 
-	var edited_content string
-	edited_content = post.Content
+// daemon is state of the reuploader shown to operators on the admin page.
+var daemon queue.Daemon
 
-	for i := 0; i < len(post.Content); i++ {
-		if post.Content[i] == '>' {
-			token_index = 0
-			url_begin = 0
-			url_end = 0
-			continue
-		}
-		possible_token := post.Content[i*boolToInt(i + len(tokens[token_index]) < len(post.Content)) : (i + len(tokens[token_index]))*boolToInt(i + len(tokens[token_index]) < len(post.Content))]
-		if possible_token == tokens[token_index] {
-			if token_index == 2 {
-				url_begin = i + 5
-			}
-			if token_index == 3 {
-				url_end = i - 1
-			}
-			i += len(tokens[token_index]) - 1
-			token_index++
-			if token_index >= len(tokens) {
-				image_url := post.Content[url_begin:url_end+1]
-				img := image{URL: image_url}
-				err := img.GetImageInfo()
-				if err != nil {
-					log.Printf("%s : error : %s", image_url, err)
-					main_report.Add(fmt.Sprintf("%s : error : %s\n", image_url, err))
-				}
-				if img.CheckImage(rules) {
-					if imgur.Locked {
-						log.Printf("Imgur is locked, waiting %d seconds", imgur.ResetTime)
-						time.Sleep(time.Duration(int64(imgur.ResetTime + 1) * 1000000000))
-					}
-					imgur.Locked = false
-					var retried bool = false
-					Retry:
-					new_image_url, err := imgur.UploadImage(image_url)
-					if err == nil {
-						edited_content = strings.Replace(edited_content, image_url, new_image_url, -1)
-						log.Printf("%s -> %s", image_url, new_image_url)
-						main_report.Add(fmt.Sprintf("%s -> %s\n", image_url, new_image_url))
-					} else {
-						log.Printf("%s : error : %s", image_url, err)
-						log.Print("Retrying ONCE")
-
-						main_report.Add(fmt.Sprintf("%s : error : %s\n", image_url, err))
-						main_report.Add("Retrying ONCE\n")
-
-						if !retried {
-							imgur.Locked = false
-							time.Sleep(5 * time.Second)
-							retried = true
-							goto Retry
-						}
-					}
-				} else {
-					log.Printf("Skipped %s due to rules", image_url)
-					main_report.Add(fmt.Sprintf("Skipped %s due to rules\n", image_url))
-				}
-				token_index = 0
-				url_begin = 0
-				url_end = 0
-			}
-		}
+func saveDaemon() {
+	if imgur.Locked {
+		imgurLocked.Set(1)
+	} else {
+		imgurLocked.Set(0)
+	}
+	imgurRemaining.Set(float64(imgur.Remaining))
+	daemon.ImgurLocked = imgur.Locked
+	daemon.ImgurResetTime = imgur.ResetTime
+	daemon.ImgurRemaining = imgur.Remaining
+	err := daemon.Save()
+	if err != nil {
+		slog.Error("Failed to save state of the reuploader", "error", err)
 	}
-
-	post.Content = edited_content
-	return post, nil
 }
 
-func backupPost(link string, post ljapi.LJPost) error {
-	_, filename := path.Split(link)
+// rejectTask drops the task file and tells the user why it won't be executed.
+func rejectTask(filename, reason string) task {
+	// the task is kept, so that it could be requeued once the reason is fixed
+	if queue.Retire(path.Base(filename)) != nil {
+		os.Remove(filename)
+	}
+	daemon.AddError(path.Base(filename), reason)
+	saveDaemon()
+	tasksFinished.Inc(string(queue.Failed))
+	status, err := queue.LoadStatus(path.Base(filename))
+	if (err == nil) && (status.State != queue.Cancelled) {
+		status.State = queue.Failed
+		status.Error = reason
+		status.Finished = time.Now()
+		status.Save()
+	}
+	return task{}
+}
 
-	f, err := os.Create("report/" + filename + ".txt")
-	defer f.Close()
+func loadTask(filename string) task {
+	content, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return err
+		slog.Error("Failed to load task", "task", path.Base(filename), "error", err)
+		return rejectTask(filename, "Failed to load task")
 	}
-	fmt.Fprint(f, post.Header, "\n\n\n", post.Content)
-	f.Close()
-
-	post.Content = url.PathEscape(post.Content)
-	post.Header = url.PathEscape(post.Header)
-
-	buf, err := json.Marshal(post)
+	var result task
+	err = json.Unmarshal(content, &result)
 	if err != nil {
-		return err
+		slog.Error("Failed to parse task", "task", path.Base(filename), "error", err)
+		return rejectTask(filename, "Failed to parse task")
 	}
-
-	f, err = os.Create("report/" + filename + ".json")
+	credentials, err := secret.Open(taskKey, result.Sealed)
 	if err != nil {
-		return err
+		slog.Error("Failed to decrypt task, rejecting it", "task", path.Base(filename), "error", err)
+		return rejectTask(filename, "Failed to decrypt credentials")
 	}
-	fmt.Fprint(f, string(buf))
-	return nil
+	err = json.Unmarshal(credentials, &result.LJ)
+	if err != nil {
+		slog.Error("Failed to parse credentials of task, rejecting it", "task", path.Base(filename), "error", err)
+		return rejectTask(filename, "Failed to parse credentials")
+	}
+	set, errs := rules.Parse(result.Rules)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			slog.Error("Invalid rules in task, rejecting it", "task", path.Base(filename), "error", e)
+		}
+		return rejectTask(filename, "Invalid rules")
+	}
+	result.RuleSet = set
+	result.Filename = filename
+	slog.Info("Loaded task", "task", path.Base(filename), "user", result.LJ.User)
+	return result
 }
 
-func initReportDir() {
-	os.RemoveAll("report/")
-	os.Mkdir("report/", 0777)
+// checkControl is asked by the job between images and posts, it returns false once the user
+// has paused or cancelled the task.
+func checkControl() bool {
+	return queue.GetControl(main_report.Status.ID) == queue.ControlNone
 }
 
 func executeTask(subject task) {
-	initReportDir()
-	main_report.Begin()
+	var id string = path.Base(subject.Filename)
+	// the control is left as it is, pause or cancel sent while the task waited still apply
+	if !main_report.Begin(id, subject.LJ.User) {
+		return
+	}
 	defer main_report.Finish()
-	main_report.Add(fmt.Sprintf("Started executing task for %s\n", subject.LJ.User))
-	for _, link := range subject.Links {
-		main_report.Add(fmt.Sprintf("Started reuploading for post %s\n", link))
-		post, err := subject.LJ.GetPost(link)
-		if err != nil {
-			log.Printf("Failed to get post %s", link)
-			main_report.Add(fmt.Sprintf("Failed to get post %s\n", link))
-			log.Print(err)
-			continue
-		}
-		err = backupPost(link, post)
-		if err != nil {
-			log.Printf("Failed to backup post %s", link)
-			main_report.Add(fmt.Sprintf("Failed to backup post %s\n", link))
-			log.Print(err)
-			continue
-		}
-		post, err = processPost(post, subject.Rules)
-		if err != nil {
-			log.Printf("Failed to process post %s", link)
-			main_report.Add(fmt.Sprintf("Failed to process post %s\n", link))
-			log.Print(err)
-			continue
-		}
-		err = subject.LJ.EditPost(post)
-		if err == nil {
-			log.Printf("%s : done", link)
-			main_report.Add(fmt.Sprintf("%s : done\n", link))
-		} else {
-			log.Printf("%s : error : %s", link, err)
-			main_report.Add(fmt.Sprintf("%s : error : %s\n", link, err))
-		}
+	main_report.Status.Email = subject.Email
+	main_report.Status.Posts = len(subject.Links)
+	// long tasks run in slices, so that other users don't wait for them
+	var first, last int = main_report.Status.NextPost, len(subject.Links)
+	if first > last {
+		first = last
 	}
-	if !imgur.Locked {
-		err := mail.SendReport(subject.Email, subject.LJ.User)
-		if err != nil {
-			log.Print(err)
-		} else {
-			log.Printf("Successfuly sent email to %s", subject.Email)
-		}
-		main_report.Finish()
+	if (queue.SlicePosts > 0) && (first + queue.SlicePosts < last) {
+		last = first + queue.SlicePosts
+	}
+	job := worker.Job{Task: subject.Task, Dir: main_report.Dir, Report: &main_report, Continue: checkControl}
+	job.Links = subject.Links[first:last]
+	job.Userpics = subject.Userpics && (last == len(subject.Links))
+	job.Run()
+	var state queue.State = queue.Done
+	var result string = ""
+	// a paused task leaves the reuploader to others, it goes on from the unfinished post once resumed
+	if job.Stopped() && (queue.GetControl(id) != queue.ControlCancel) {
+		main_report.Publish(queue.Event{Kind: queue.EventFinished, Message: "Paused, the task will go on from the unfinished post once resumed"})
+		main_report.End(queue.Paused, "")
+		tasksFinished.Inc("paused")
+		return
+	}
+	if job.Stopped() {
+		state = queue.Cancelled
+		result = "Cancelled by user"
+		main_report.Publish(queue.Event{Kind: queue.EventFinished, Message: "Cancelled, report contains what was done before"})
+		queue.SetControl(id, queue.ControlNone)
+	} else if imgur.Locked {
+		main_report.Publish(queue.Event{Kind: queue.EventFinished, Message: "Imgur limit reached, the task will go on from the unfinished post"})
+		main_report.End(queue.Queued, "Imgur limit reached, the task will go on from the unfinished post")
+		tasksFinished.Inc("rate_limited")
+		return
+	} else if last < len(subject.Links) {
+		main_report.Log(slog.LevelInfo, "", fmt.Sprintf("Processed %d of %d posts, giving way to other tasks", last, len(subject.Links)))
+		main_report.End(queue.Queued, "")
+		return
+	} else {
+		main_report.Publish(queue.Event{Kind: queue.EventFinished, Message: "Finished"})
+	}
+	main_report.Finish()
+	err := queue.ArchiveReport(id)
+	if err != nil {
+		main_report.Logger.Error("Failed to archive report", "error", err)
+	}
+	err = mail.SendReport(subject.Email, subject.LJ.User, queue.ReportArchive(id))
+	if err != nil {
+		emailsSent.Inc("error")
+		main_report.Logger.Error("Failed to send email", "email", subject.Email, "error", err)
+	} else {
+		emailsSent.Inc("ok")
+		main_report.Logger.Info("Successfuly sent email", "email", subject.Email)
+	}
+	main_report.End(state, result)
+	tasksFinished.Inc(string(state))
+	err = queue.Retire(id)
+	if err != nil {
+		main_report.Logger.Error("Failed to retire task", "error", err)
 		os.Remove(subject.Filename)
 	}
 }
 
+// Old reports are looked for this often, it takes reading every status.
+const CLEANUP_INTERVAL = time.Hour
+
 func main() {
 	if !loadConfig("ljir.conf") {
 		return
 	}
-	initReportDir()
+	queue.Init()
+	daemon, _ = queue.LoadDaemon()
+	metrics.Serve(conf.MetricsAddress)
 	var check_id int = -1
+	var cleaned time.Time
 	for true {
 		if imgur.Locked {
-			log.Printf("Imgur is locked, waiting %d seconds", imgur.ResetTime)
-			time.Sleep(time.Duration(int64(imgur.ResetTime + 1) * 1000000000))
+			saveDaemon()
+			worker.WaitForImgur()
 		}
 		imgur.Locked = false
 		time.Sleep(5 * time.Second)
 		check_id++
-		tasks, err := ioutil.ReadDir("tasks/")
+		saveDaemon()
+		err := queue.RemoveRetired(time.Duration(conf.RetiredTaskHours) * time.Hour)
+		if err != nil {
+			slog.Error("Failed to remove retired tasks", "check", check_id, "error", err)
+		}
+		if (conf.ReportRetentionDays > 0) && (time.Since(cleaned) > CLEANUP_INTERVAL) {
+			cleaned = time.Now()
+			err = queue.RemoveFinished(time.Duration(conf.ReportRetentionDays) * 24 * time.Hour)
+			if err != nil {
+				slog.Error("Failed to remove old reports", "check", check_id, "error", err)
+			}
+		}
+		tasks, err := queue.Order()
 		if err != nil {
-			log.Printf("Check #%d: Failed to check tasks", check_id)
-			log.Print(err)
+			slog.Error("Failed to check tasks", "check", check_id, "error", err)
 			continue
 		}
 		if len(tasks) == 0 {
-			log.Printf("Check #%d: No tasks were found", check_id)
+			slog.Debug("No tasks were found", "check", check_id)
+			continue
+		}
+		subject := loadTask(queue.TaskFile(tasks[0]))
+		if subject.Filename == "" {
 			continue
 		}
-		executeTask(loadTask("tasks/" + tasks[0].Name()))
-		log.Printf("Imgur reset time: %d", imgur.ResetTime)
+		executeTask(subject)
+		slog.Info("Task slice executed", "task", path.Base(subject.Filename), "imgur_reset_time", imgur.ResetTime, "imgur_remaining", imgur.Remaining)
 	}
 }
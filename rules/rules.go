@@ -0,0 +1,447 @@
+// Package rules implements the language used to select images for reuploading.
+//
+// Every non-empty line of a rule set is either a directive or a rule:
+//
+//	MATCH first|last        which of the matching rules decides (default: first)
+//	DEFAULT reupload|skip   what to do when no rule matches (default: reupload)
+//	REUPLOAD cond...        reupload images matching all conditions
+//	SKIP cond...            skip images matching all conditions
+//
+// A condition is key, operator and value written without spaces, optionally
+// negated with "!": domain=*.photobucket.com, path=/albums/*, url~\.gif$,
+// mime=image/*, size>4K, width<=16, class=dead, info=unknown, format=gif,
+// animated. Several values may be listed with commas.
+// Lines starting with "#" are comments.
+//
+// Shorthand directives INCLUDE, EXCLUDE, MORETHAN, LESSTHAN, MINWIDTH, MINHEIGHT,
+// MAXWIDTH, MAXHEIGHT and FORMAT are translated into SKIP rules.
+package rules
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Action int
+
+const (
+	Reupload Action = iota
+	Skip
+)
+
+func (a Action) String() string {
+	if a == Skip {
+		return "skip"
+	}
+	return "reupload"
+}
+
+// Health classes of images, see Image.Class.
+const (
+	ClassOK = "ok"
+	ClassDead = "dead"
+	ClassPlaceholder = "placeholder"
+	ClassBlocked = "blocked"
+)
+
+var classes = []string{ClassOK, ClassDead, ClassPlaceholder, ClassBlocked}
+
+// Whenever type and size of image could be found, see Image.Info.
+const (
+	InfoKnown = "known"
+	InfoUnknown = "unknown"
+)
+
+// Image holds everything rules may look at. Zero numbers and empty strings mean unknown,
+// conditions on unknown attributes never match, except those of MORETHAN and LESSTHAN, which
+// skip images of unknown size as they always did. Info tells whenever type and size are known at all.
+type Image struct {
+	URL, Domain, Path, MIME, Class, Info, Format	string
+	Size, Width, Height								int
+	Animated										bool
+}
+
+// Error is a problem found in a specific line of rule set.
+type Error struct {
+	Line	int
+	Msg		string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+type condition struct {
+	negate	bool
+	unknown	bool	// result when the attribute is unknown
+	key, op	string
+	values	[]string
+	numbers	[]int
+	regexps	[]*regexp.Regexp
+}
+
+// Rule is a single parsed line of rule set.
+type Rule struct {
+	Line		int
+	Text		string
+	Action		Action
+	conditions	[]condition
+}
+
+// Set is an ordered list of rules.
+type Set struct {
+	Rules		[]*Rule
+	LastMatch	bool
+	Default		Action
+}
+
+var conditionPattern = regexp.MustCompile(`^(!?)([a-z]+)(<=|>=|=|~|<|>)(.+)$`)
+
+var keyOperators = map[string]string {
+	"domain": "=~",
+	"path": "=~",
+	"url": "=~",
+	"mime": "=~",
+	"size": "=<>",
+	"width": "=<>",
+	"height": "=<>",
+	"class": "=",
+	"info": "=",
+	"format": "=",
+	"animated": "=",
+}
+
+func parseNumber(text string) (int, error) {
+	var multiplier int = 1
+	switch {
+		case strings.HasSuffix(text, "K"): multiplier = 1024
+		case strings.HasSuffix(text, "M"): multiplier = 1024 * 1024
+	}
+	if multiplier != 1 {
+		text = text[:len(text)-1]
+	}
+	n, err := strconv.Atoi(text)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a valid number", text)
+	}
+	return n * multiplier, nil
+}
+
+func parseCondition(text string) (condition, error) {
+	// bare flag, such as "animated", means flag=yes
+	if strings.TrimPrefix(text, "!") == "animated" {
+		text = text + "=yes"
+	}
+	match := conditionPattern.FindStringSubmatch(text)
+	if match == nil {
+		return condition{}, fmt.Errorf("%q is not a condition", text)
+	}
+	cond := condition{negate: match[1] == "!", key: match[2], op: match[3], values: strings.Split(match[4], ",")}
+	operators, ok := keyOperators[cond.key]
+	if !ok {
+		return condition{}, fmt.Errorf("unknown key %q", cond.key)
+	}
+	if !strings.Contains(operators, cond.op[:1]) {
+		return condition{}, fmt.Errorf("operator %q can't be used with %q", cond.op, cond.key)
+	}
+	for _, value := range cond.values {
+		if value == "" {
+			return condition{}, fmt.Errorf("empty value in %q", text)
+		}
+		switch {
+			case cond.op == "~":
+				re, err := regexp.Compile(value)
+				if err != nil {
+					return condition{}, fmt.Errorf("bad regular expression %q: %s", value, err)
+				}
+				cond.regexps = append(cond.regexps, re)
+			case strings.Contains(operators, "<"):
+				n, err := parseNumber(value)
+				if err != nil {
+					return condition{}, err
+				}
+				cond.numbers = append(cond.numbers, n)
+			case cond.key == "class":
+				var known bool = false
+				for _, class := range classes {
+					known = known || (value == class)
+				}
+				if !known {
+					return condition{}, fmt.Errorf("unknown class %q, expected one of %s", value, strings.Join(classes, ", "))
+				}
+			case cond.key == "animated":
+				if (value != "yes") && (value != "no") {
+					return condition{}, fmt.Errorf("animated is either yes or no")
+				}
+			case cond.key == "info":
+				if (value != InfoKnown) && (value != InfoUnknown) {
+					return condition{}, fmt.Errorf("info is either %s or %s", InfoKnown, InfoUnknown)
+				}
+			default:
+				if _, err := path.Match(value, ""); err != nil {
+					return condition{}, fmt.Errorf("bad pattern %q", value)
+				}
+		}
+	}
+	return cond, nil
+}
+
+func matchDomain(pattern, domain string) bool {
+	if strings.HasPrefix(pattern, "*.") && (domain == pattern[2:]) {
+		return true
+	}
+	if strings.HasPrefix(pattern, ".") {
+		return strings.HasSuffix(domain, pattern) || (domain == pattern[1:])
+	}
+	ok, _ := path.Match(pattern, domain)
+	return ok
+}
+
+func compare(op string, a, b int) bool {
+	switch op {
+		case "<": return a < b
+		case "<=": return a <= b
+		case ">": return a > b
+		case ">=": return a >= b
+	}
+	return a == b
+}
+
+func (c condition) attribute(img Image) (string, int) {
+	switch c.key {
+		case "domain": return strings.ToLower(img.Domain), 0
+		case "path": return img.Path, 0
+		case "url": return img.URL, 0
+		case "mime": return img.MIME, 0
+		case "size": return "", img.Size
+		case "width": return "", img.Width
+		case "height": return "", img.Height
+		case "class": return img.Class, 0
+		case "info": return img.Info, 0
+		case "format": return img.Format, 0
+		case "animated":
+			if img.Format == "" {
+				return "", 0
+			}
+			if img.Animated {
+				return "yes", 0
+			}
+			return "no", 0
+	}
+	return "", 0
+}
+
+func (c condition) match(img Image) bool {
+	text, number := c.attribute(img)
+	if (text == "") && (number == 0) {
+		return c.unknown
+	}
+	var found bool = false
+	switch {
+		case c.regexps != nil:
+			for _, re := range c.regexps {
+				found = found || re.MatchString(text)
+			}
+		case c.numbers != nil:
+			for _, n := range c.numbers {
+				found = found || compare(c.op, number, n)
+			}
+		case c.key == "domain":
+			for _, pattern := range c.values {
+				found = found || matchDomain(strings.ToLower(pattern), text)
+			}
+		default:
+			for _, pattern := range c.values {
+				ok, _ := path.Match(pattern, text)
+				found = found || ok
+			}
+	}
+	return found != c.negate
+}
+
+// Match tells whenever image satisfies all conditions of the rule.
+func (r *Rule) Match(img Image) bool {
+	for _, cond := range r.conditions {
+		if !cond.match(img) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseWord(word string) (Action, bool) {
+	switch strings.ToLower(word) {
+		case "reupload": return Reupload, true
+		case "skip": return Skip, true
+	}
+	return Reupload, false
+}
+
+func numberArgument(fields []string) (int, error) {
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("%s expects exactly one number", fields[0])
+	}
+	return parseNumber(fields[1])
+}
+
+// Parse builds rule set from lines of text. All problems are reported at once.
+func Parse(lines []string) (*Set, []Error) {
+	set := &Set{Default: Reupload}
+	var errs []Error
+	var include *Rule = nil
+	for index, line := range lines {
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		if (len(fields) == 0) || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		fail := func(err error) {
+			errs = append(errs, Error{Line: index + 1, Msg: err.Error()})
+		}
+		rule := &Rule{Line: index + 1, Text: line, Action: Skip}
+		switch strings.ToUpper(fields[0]) {
+			case "MATCH":
+				if (len(fields) != 2) || ((fields[1] != "first") && (fields[1] != "last")) {
+					fail(fmt.Errorf("MATCH expects first or last"))
+				}
+				set.LastMatch = (len(fields) == 2) && (fields[1] == "last")
+				continue
+			case "DEFAULT":
+				action, ok := Reupload, false
+				if len(fields) == 2 {
+					action, ok = parseWord(fields[1])
+				}
+				if !ok {
+					fail(fmt.Errorf("DEFAULT expects reupload or skip"))
+				}
+				set.Default = action
+				continue
+			case "REUPLOAD", "SKIP":
+				rule.Action, _ = parseWord(fields[0])
+				if len(fields) == 1 {
+					fail(fmt.Errorf("%s needs at least one condition", fields[0]))
+					continue
+				}
+				for _, field := range fields[1:] {
+					cond, err := parseCondition(field)
+					if err != nil {
+						fail(err)
+						continue
+					}
+					rule.conditions = append(rule.conditions, cond)
+				}
+			case "MORETHAN":
+				n, err := numberArgument(fields)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				rule.conditions = []condition{{key: "size", op: "<=", numbers: []int{n}, unknown: true}}
+			case "LESSTHAN":
+				n, err := numberArgument(fields)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				rule.conditions = []condition{{key: "size", op: ">=", numbers: []int{n}, unknown: true}}
+			case "MINWIDTH", "MINHEIGHT", "MAXWIDTH", "MAXHEIGHT":
+				n, err := numberArgument(fields)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				directive := strings.ToLower(fields[0])
+				cond := condition{key: directive[3:], op: "<", numbers: []int{n}}
+				if strings.HasPrefix(directive, "max") {
+					cond.op = ">"
+				}
+				rule.conditions = []condition{cond}
+			case "FORMAT":
+				if len(fields) == 1 {
+					fail(fmt.Errorf("FORMAT needs at least one format"))
+					continue
+				}
+				var formats []string
+				for _, format := range fields[1:] {
+					formats = append(formats, strings.ToLower(format))
+				}
+				rule.conditions = []condition{{negate: true, key: "format", op: "=", values: formats}}
+			case "EXCLUDE":
+				if len(fields) == 1 {
+					fail(fmt.Errorf("EXCLUDE needs at least one domain"))
+					continue
+				}
+				rule.conditions = []condition{{key: "domain", op: "=", values: fields[1:]}}
+			case "INCLUDE":
+				if len(fields) == 1 {
+					fail(fmt.Errorf("INCLUDE needs at least one domain"))
+					continue
+				}
+				// INCLUDE lines form a single whitelist, everything outside of it is skipped
+				if include != nil {
+					include.Text = include.Text + "; " + line
+					include.conditions[0].values = append(include.conditions[0].values, fields[1:]...)
+					continue
+				}
+				include = rule
+				rule.conditions = []condition{{negate: true, key: "domain", op: "=", values: fields[1:]}}
+			default:
+				fail(fmt.Errorf("unknown directive %q", fields[0]))
+				continue
+		}
+		set.Rules = append(set.Rules, rule)
+	}
+	if include != nil {
+		for _, domain := range include.conditions[0].values {
+			if domain == "*" {
+				set.remove(include)
+				break
+			}
+		}
+	}
+	return set, errs
+}
+
+func (s *Set) remove(rule *Rule) {
+	for i, r := range s.Rules {
+		if r == rule {
+			s.Rules = append(s.Rules[:i], s.Rules[i+1:]...)
+			return
+		}
+	}
+}
+
+// Uses tells whenever any rule of the set looks at any of keys, so that expensive attributes
+// are collected only when needed.
+func (s *Set) Uses(keys ...string) bool {
+	for _, rule := range s.Rules {
+		for _, cond := range rule.conditions {
+			for _, key := range keys {
+				if cond.key == key {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Check decides what to do with image. The deciding rule is returned as well, nil means default.
+func (s *Set) Check(img Image) (Action, *Rule) {
+	var decided *Rule = nil
+	for _, rule := range s.Rules {
+		if rule.Match(img) {
+			decided = rule
+			if !s.LastMatch {
+				break
+			}
+		}
+	}
+	if decided == nil {
+		return s.Default, nil
+	}
+	return decided.Action, decided
+}
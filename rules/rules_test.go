@@ -0,0 +1,92 @@
+package rules
+
+import (
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+	lines := []string{
+		"# comment",
+		"",
+		"SKIP size>",
+		"BOGUS x",
+		"MORETHAN abc",
+		"INCLUDE",
+		"SKIP class=gone",
+		"MATCH sometimes",
+		"SKIP domain=a.com",
+	}
+	set, errs := Parse(lines)
+	var expected = []int{3, 4, 5, 6, 7, 8}
+	if len(errs) != len(expected) {
+		t.Fatalf("got %d errors, expected %d : %v", len(errs), len(expected), errs)
+	}
+	for index, line := range expected {
+		if errs[index].Line != line {
+			t.Errorf("error %d : got line %d, expected %d : %s", index, errs[index].Line, line, errs[index])
+		}
+	}
+	if (len(set.Rules) == 0) || (set.Rules[len(set.Rules)-1].Line != 9) {
+		t.Errorf("valid rules after errors are kept with their line numbers")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	var cases = []struct {
+		name	string
+		rules	[]string
+		image	Image
+		action	Action
+	}{
+		{"no rules", nil, Image{Domain: "a.com"}, Reupload},
+		{"default skip", []string{"DEFAULT skip"}, Image{Domain: "a.com"}, Skip},
+		{"exclude", []string{"EXCLUDE a.com"}, Image{Domain: "a.com"}, Skip},
+		{"exclude other", []string{"EXCLUDE a.com"}, Image{Domain: "b.com"}, Reupload},
+		{"include first line", []string{"INCLUDE a.com", "INCLUDE b.com"}, Image{Domain: "a.com"}, Reupload},
+		{"include second line", []string{"INCLUDE a.com", "INCLUDE b.com"}, Image{Domain: "b.com"}, Reupload},
+		{"outside of include", []string{"INCLUDE a.com", "INCLUDE b.com"}, Image{Domain: "c.com"}, Skip},
+		{"include everything", []string{"INCLUDE a.com", "INCLUDE *"}, Image{Domain: "c.com"}, Reupload},
+		{"subdomain", []string{"SKIP domain=*.a.com"}, Image{Domain: "img.a.com"}, Skip},
+		{"morethan bigger", []string{"MORETHAN 4K"}, Image{Size: 5000}, Reupload},
+		{"morethan smaller", []string{"MORETHAN 4K"}, Image{Size: 100}, Skip},
+		{"morethan unknown", []string{"MORETHAN 4K"}, Image{}, Skip},
+		{"lessthan smaller", []string{"LESSTHAN 4K"}, Image{Size: 100}, Reupload},
+		{"lessthan bigger", []string{"LESSTHAN 4K"}, Image{Size: 5000}, Skip},
+		{"lessthan unknown", []string{"LESSTHAN 4K"}, Image{}, Skip},
+		{"include everything with morethan", []string{"INCLUDE *", "MORETHAN 4096"}, Image{Domain: "a.com"}, Skip},
+		{"unknown width", []string{"SKIP width<16"}, Image{}, Reupload},
+		{"negated unknown", []string{"SKIP !format=gif"}, Image{}, Reupload},
+		{"format", []string{"FORMAT jpeg png"}, Image{Format: "gif"}, Skip},
+		{"animated", []string{"SKIP animated"}, Image{Format: "gif", Animated: true}, Skip},
+		{"first match", []string{"SKIP domain=a.com", "REUPLOAD format=gif"}, Image{Domain: "a.com", Format: "gif"}, Skip},
+		{"last match", []string{"MATCH last", "SKIP domain=a.com", "REUPLOAD format=gif"}, Image{Domain: "a.com", Format: "gif"}, Reupload},
+		{"all conditions", []string{"SKIP domain=a.com size>1K"}, Image{Domain: "a.com", Size: 100}, Reupload},
+	}
+	for _, c := range cases {
+		set, errs := Parse(c.rules)
+		if len(errs) > 0 {
+			t.Errorf("%s : %v", c.name, errs)
+			continue
+		}
+		if action, _ := set.Check(c.image); action != c.action {
+			t.Errorf("%s : got %s, expected %s", c.name, action, c.action)
+		}
+	}
+}
+
+func TestIncludeMerged(t *testing.T) {
+	set, errs := Parse([]string{"INCLUDE a.com", "SKIP size>1M", "INCLUDE b.com"})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if len(set.Rules) != 2 {
+		t.Fatalf("got %d rules, expected 2", len(set.Rules))
+	}
+	if set.Rules[0].Text != "INCLUDE a.com; INCLUDE b.com" {
+		t.Errorf("merged rule text is %q", set.Rules[0].Text)
+	}
+	_, rule := set.Check(Image{Domain: "c.com"})
+	if (rule == nil) || (rule.Line != 1) {
+		t.Errorf("image outside of include is decided by %+v", rule)
+	}
+}
@@ -0,0 +1,72 @@
+// Package secret seals task credentials with a key shared by the front-end and the reuploader.
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// KeySize is the length of AES-256 key in bytes.
+const KeySize = 32
+
+// LoadKey reads a hex-encoded AES-256 key from file.
+func LoadKey(filename string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != KeySize {
+		return nil, errors.New("Key must be 32 bytes long")
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts plaintext with AES-GCM and returns base64 of nonce followed by ciphertext.
+func Seal(key, plaintext []byte) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a string produced by Seal.
+func Open(key []byte, sealed string) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < aead.NonceSize() {
+		return nil, errors.New("Sealed data is too short")
+	}
+	nonce, ciphertext := buf[:aead.NonceSize()], buf[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
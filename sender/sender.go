@@ -1,12 +1,10 @@
 package sender
 
 import (
-	"os/exec"
 	"net/smtp"
 	"net/mail"
 	"./email"
 	"fmt"
-	"os"
 )
 
 type SMTPSettings struct {
@@ -15,13 +13,7 @@ type SMTPSettings struct {
 	SmtpServer		string	`json:"smtp_server"`
 }
 
-func tarReport() error {
-	cmd := exec.Command("tar", "-zcf", "report.tar.gz", "report/")
-	err := cmd.Run()
-	return err
-}
-
-func (settings *SMTPSettings) SendReport(address, name string) error {
+func (settings *SMTPSettings) SendReport(address, name, archive string) error {
 	const PATTERN = `Уважаемый %s,
 Спасибо за использование LJIR Online. Ваша заявка была обработана в той или иной степени, и разработчик выражает искреннюю надежду, что в той, а не иной.
 Даже если LJIR умудрился вам что-то попортить, он  ̶п̶о̶п̶р̶о̶с̶и̶т̶ ̶п̶р̶о̶щ̶е̶н̶и̶я̶ делал резервные копии постов, так что восстановить их не составит труда. Конечно, если внезапно копии не окажутся битыми, хехехе.
@@ -32,12 +24,6 @@ func (settings *SMTPSettings) SendReport(address, name string) error {
 С уважением,
 func SendReport(address, name string)`
 
-	err := tarReport()
-	if err != nil {
-		return err
-	}
-	defer os.Remove("report.tar.gz")
-
 	text := fmt.Sprintf(PATTERN, name)
 
 	auth := smtp.PlainAuth(
@@ -50,7 +36,7 @@ func SendReport(address, name string)`
 	msg := email.NewMessage("Отчёт об обработке", text)
 	msg.From = mail.Address{Name: "LJIR Online", Address: "report@ljir.devnullinc.pp.ua"}
 	msg.To = []string{address}
-	err = msg.Attach("report.tar.gz")
+	err := msg.Attach(archive)
 	if err != nil {
 		return err
 	}
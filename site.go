@@ -3,18 +3,30 @@ package main
 import (
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"io/ioutil"
 	"io"
 	"os"
 	"strings"
+	"html"
 	"strconv"
 	"crypto/md5"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"sync"
 	"time"
-	"math/rand"
 	"./ljapi"
+	"./secret"
+	"./rules"
+	"./images"
+	"./queue"
+	"./metrics"
+	"./logging"
 	"syscall"
 )
 
@@ -24,30 +36,59 @@ type settings struct {
 	UseTLS 		bool		`json:"site_tls"`
 	GroupID		int			`json:"gid"`
 	UserID 		int			`json:"uid"`
+	TaskKey		string	`json:"task_key"`
+	QuotaTasks	int		`json:"quota_tasks"`
+	QuotaPosts	int		`json:"quota_posts"`
+	QuotaImages	int		`json:"quota_images_per_day"`
+	SlicePosts	int		`json:"slice_posts"`
+	Admins		[]string	`json:"admins"`
+	MetricsAddress	string	`json:"site_metrics_address"`
 }
 
+var logConfig logging.Config
+
 var conf settings = settings {
 	CertFile: "",
 	KeyFile: "",
 	UseTLS: false,
 	GroupID: os.Getgid(),
 	UserID: os.Getuid(),
+	TaskKey: "ljir.key",
+	SlicePosts: queue.SlicePosts,
 }
 
+var taskKey []byte
+
+var (
+	tasksSubmitted = metrics.NewCounter("ljir_tasks_submitted_total", "Tasks put into the queue, by the way they came.", "source")
+	tasksRefused = metrics.NewCounter("ljir_tasks_refused_total", "Tasks which were not accepted, by reason.", "source", "reason")
+)
+
 func loadConfig(filename string) {
 	content, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Print("Failed to read config file. Using default settings. ")
-		log.Print(err)
+		slog.Warn("Failed to read config file, using default settings", "error", err)
 		return
 	}
 	err = json.Unmarshal(content, &conf)
 	if err != nil {
-		log.Print("Failed to parse config file. Using default settings. ")
-		log.Print(err)
+		slog.Warn("Failed to parse config file, using default settings", "error", err)
+		return
+	}
+	err = json.Unmarshal(content, &images.Config)
+	if err != nil {
+		slog.Warn("Failed to parse config file, using default settings", "error", err)
+		return
+	}
+	err = json.Unmarshal(content, &logConfig)
+	if err == nil {
+		err = logging.Setup(logConfig)
+	}
+	if err != nil {
+		slog.Warn("Invalid logging settings, using default ones", "error", err)
 		return
 	}
-	log.Print("Config file successfuly loaded.")
+	slog.Info("Config file successfuly loaded")
 }
 
 func loadPage(response http.ResponseWriter, filename string) {
@@ -55,7 +96,7 @@ func loadPage(response http.ResponseWriter, filename string) {
 	f, err := os.Open(filename)
 	defer f.Close()
 	if err != nil {
-		log.Print(err)
+		slog.Error("Failed to open page", "page", filename, "error", err)
 		f, err = os.Open("pages/500.html")
 		if err != nil {
 			response.WriteHeader(http.StatusInternalServerError)
@@ -70,13 +111,93 @@ func loadStyleSheet(response http.ResponseWriter) {
         f, err := os.Open("pages/style.css")
 		defer f.Close()
         if err != nil {
-				log.Print(err)
+				slog.Error("Failed to open style sheet", "error", err)
                 loadPage(response, "pages/500.html")
                 return
         }
         io.Copy(response, f)
 }
 
+// Sessions of the web form are kept in memory of the site, so the password is checked once
+// and never comes back to the browser. The cookie holds only the session id, signed with a key
+// made at start, sessions don't survive a restart anyway.
+
+const SESSION_COOKIE = "ljir_session"
+const SESSION_LIFETIME = 2 * time.Hour
+
+type session struct {
+	LJ ljapi.LJClient
+	Email string
+	Expires time.Time
+}
+
+var sessions = struct {
+	sync.Mutex
+	byID map[string]session
+}{byID: make(map[string]session)}
+
+var sessionKey []byte = func() []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}()
+
+func signSession(id string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// startSession remembers the checked credentials and gives the browser a cookie for them.
+func startSession(response http.ResponseWriter, lj ljapi.LJClient, email string) error {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return err
+	}
+	var id string = hex.EncodeToString(buf)
+	var expires time.Time = time.Now().Add(SESSION_LIFETIME)
+	sessions.Lock()
+	for key, value := range sessions.byID {
+		if time.Now().After(value.Expires) {
+			delete(sessions.byID, key)
+		}
+	}
+	sessions.byID[id] = session{LJ: lj, Email: email, Expires: expires}
+	sessions.Unlock()
+	http.SetCookie(response, &http.Cookie{
+		Name: SESSION_COOKIE,
+		Value: id + "." + signSession(id),
+		Path: "/",
+		Expires: expires,
+		HttpOnly: true,
+		Secure: conf.UseTLS,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+func currentSession(request *http.Request) (session, bool) {
+	cookie, err := request.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return session{}, false
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if (len(parts) != 2) || !hmac.Equal([]byte(parts[1]), []byte(signSession(parts[0]))) {
+		return session{}, false
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	value, ok := sessions.byID[parts[0]]
+	if !ok || time.Now().After(value.Expires) {
+		return session{}, false
+	}
+	return value, true
+}
+
 func loadOptionsPage(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "text/html; charset=utf-8")
 	err := request.ParseForm()
@@ -84,9 +205,13 @@ func loadOptionsPage(response http.ResponseWriter, request *http.Request) {
 		loadPage(response, "pages/500.html")
 		return
 	}
-	user := request.Form.Get("user")
+	user, valid := canonicalUser(request.Form.Get("user"))
 	password := request.Form.Get("password")
 	email := request.Form.Get("email")
+	if !valid {
+		loadPage(response, "pages/400.html")
+		return
+	}
 
 	buf := md5.Sum([]byte(password))
 	passhash := hex.EncodeToString(buf[:])
@@ -94,12 +219,12 @@ func loadOptionsPage(response http.ResponseWriter, request *http.Request) {
 	lj := ljapi.LJClient{User: user, PassHash: passhash}
 	ok, err := lj.TryLogIn()
 	if err != nil {
-		log.Print(err)
+		slog.Error("Failed to log in to LJ", "user", user, "error", err)
 		loadPage(response, "pages/500.html")
 		return
 	}
 	if !ok {
-		log.Print("loadOptionsPage(): wrong password")
+		slog.Warn("Wrong LJ password", "user", user)
 		loadPage(response, "pages/403.html")
 		return
 	}
@@ -113,66 +238,1164 @@ func loadOptionsPage(response http.ResponseWriter, request *http.Request) {
 		loadPage(response, "pages/500.html")
 		return
 	}
+	err = startSession(response, lj, email)
+	if err != nil {
+		slog.Error("Failed to start session", "user", user, "error", err)
+		loadPage(response, "pages/500.html")
+		return
+	}
 	var str_content string = string(content)
-	fmt.Fprintf(response, str_content, user, password, email, email)
-	log.Print("loadOptionsPage(): password OK")
+	fmt.Fprintf(response, str_content, html.EscapeString(email))
+	slog.Info("Logged in to LJ", "user", user)
 }
 
-func getNonce() string {
-	const ALPHABET = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	var res string = ""
-	for i := 0; i < 8; i++ {
-		res = res + string(ALPHABET[rand.Intn(len(ALPHABET))])
+func validateLinks(text string) ([]string, []string) {
+	var links, problems []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parsed, err := ljapi.ParsePostURL(line)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		links = append(links, parsed.String())
 	}
-	return res
+	return links, problems
 }
 
-func registerReuploadQuery(response http.ResponseWriter, request *http.Request) {
-	type reuploadQuery struct {
-		LJ		ljapi.LJClient	`json:"lj_client"`
-		Email string					`json:"email"`
-		Links []string				`json:"links"`
-		Rules []string				`json:"rules"`
+func parseProcessing(request *http.Request) (images.Processing, []string) {
+	var problems []string
+	processing := images.Processing{
+		Transcode: request.Form.Get("transcode") != "",
+		TranscodeFormat: request.Form.Get("transcode_format"),
+		StripMetadata: request.Form.Get("strip_metadata") != "",
+	}
+	if (processing.TranscodeFormat != "png") && (processing.TranscodeFormat != "jpeg") {
+		processing.TranscodeFormat = "png"
 	}
+	number := func(name string) int {
+		text := strings.TrimSpace(request.Form.Get(name))
+		if text == "" {
+			return 0
+		}
+		n, err := strconv.Atoi(text)
+		if (err != nil) || (n < 0) {
+			problems = append(problems, fmt.Sprintf("%s : not a valid number", text))
+			return 0
+		}
+		return n
+	}
+	processing.MaxDimension = number("max_dimension")
+	processing.MaxSize = number("max_size") * 1024
+	return processing, problems
+}
 
-	var taskfile string = strconv.Itoa(int(time.Now().Unix())) + "-" + getNonce()
-	taskfile = "tasks/"+taskfile
-	f, err := os.Create(taskfile)
-	defer f.Close()
-	err = request.ParseForm()
+func loadErrorsPage(response http.ResponseWriter, problems []string) {
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	content, err := ioutil.ReadFile("pages/errors.html")
 	if err != nil {
-		log.Print(err)
 		loadPage(response, "pages/500.html")
 		return
 	}
-	lj_user := request.Form.Get("user")
-	buf := md5.Sum([]byte(request.Form.Get("password")))
-	lj_passhash := hex.EncodeToString(buf[:])
-	email := request.Form.Get("email")
-	links := strings.Split(request.Form.Get("links"), "\r\n")
-	rules := strings.Split(request.Form.Get("rules"), "\r\n")
-	if ((lj_user == "") || (email == "") || (len(links) == 0) || (len(rules) == 0)) {
+	var list string = ""
+	for _, problem := range problems {
+		list = list + html.EscapeString(problem) + "<br>\n"
+	}
+	response.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(response, string(content), list)
+}
+
+type reuploadQuery struct {
+	Sealed	string				`json:"lj_sealed"`
+	Email string					`json:"email"`
+	Links []string				`json:"links"`
+	Rules []string				`json:"rules"`
+	Comments bool				`json:"comments"`
+	Userpics bool				`json:"userpics"`
+	Processing images.Processing	`json:"processing"`
+	Rollback bool				`json:"rollback"`
+}
+
+// canonicalUser brings the login to the form LJ keeps user names in, so that Foo, foo and f-o-o
+// are one user for quotas, history and ownership of tasks. Names LJ can't have are refused.
+func canonicalUser(user string) (string, bool) {
+	user = ljapi.CanonicalJournal(strings.TrimSpace(user))
+	return user, ljapi.ValidJournal(user)
+}
+
+// sameUser compares the logged in user with the owner of a task, statuses may keep the name as it was typed.
+func sameUser(owner, user string) bool {
+	return ljapi.CanonicalJournal(owner) == user
+}
+
+func isAdmin(user string) bool {
+	for _, admin := range conf.Admins {
+		if sameUser(admin, user) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNotBefore reads the start time given in the form, in local time of the server.
+func parseNotBefore(text string) (time.Time, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return time.Time{}, nil
+	}
+	result, err := time.ParseInLocation("2006-01-02T15:04", text, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s : not a valid start time", text)
+	}
+	return result, nil
+}
+
+// submitTask seals credentials into the query and puts it into the queue.
+// Priority and start time stay in the status, where the scheduler looks for them.
+func submitTask(lj ljapi.LJClient, query reuploadQuery, priority int, not_before time.Time) (string, error) {
+	credentials, err := json.Marshal(lj)
+	if err != nil {
+		return "", err
+	}
+	query.Sealed, err = secret.Seal(taskKey, credentials)
+	if err != nil {
+		return "", err
+	}
+	js_bytes, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	var id string = queue.NewID()
+	status := queue.Status{
+		ID: id,
+		User: lj.User,
+		Email: query.Email,
+		State: queue.Queued,
+		Submitted: time.Now(),
+		Priority: priority,
+		NotBefore: not_before,
+		Posts: len(query.Links),
+	}
+	err = status.Save()
+	if err != nil {
+		return "", err
+	}
+	err = queue.WriteFile(queue.TaskFile(id), js_bytes)
+	if err != nil {
+		return "", err
+	}
+	slog.Info("Registered a reupload query", "task", id, "user", lj.User, "posts", len(query.Links), "priority", priority)
+	return id, nil
+}
+
+// checkQuota tells why the user can't queue one more task with posts posts, limits of 0 mean no limit.
+func checkQuota(user string, posts int) []string {
+	var problems []string
+	statuses, err := queue.Statuses()
+	if err != nil {
+		slog.Error("Failed to load statuses for quota", "user", user, "error", err)
+		return nil
+	}
+	var tasks, queued_posts, images int = 0, 0, 0
+	var day_ago time.Time = time.Now().Add(-24 * time.Hour)
+	for _, status := range statuses {
+		if !sameUser(status.User, user) {
+			continue
+		}
+		if (status.State == queue.Queued) || (status.State == queue.Running) || (status.State == queue.Paused) {
+			tasks++
+			queued_posts += status.Posts - status.NextPost
+		}
+		if status.LastRun.After(day_ago) {
+			images += uploadedSince(status.ID, day_ago)
+		}
+	}
+	if (conf.QuotaTasks > 0) && (tasks >= conf.QuotaTasks) {
+		problems = append(problems, fmt.Sprintf("Quota : you already have %d unfinished tasks, the limit is %d", tasks, conf.QuotaTasks))
+	}
+	if (conf.QuotaPosts > 0) && (queued_posts + posts > conf.QuotaPosts) {
+		problems = append(problems, fmt.Sprintf("Quota : %d posts are waiting already, with %d more it exceeds the limit of %d", queued_posts, posts, conf.QuotaPosts))
+	}
+	if (conf.QuotaImages > 0) && (images >= conf.QuotaImages) {
+		problems = append(problems, fmt.Sprintf("Quota : %d images were reuploaded during the last day, the limit is %d", images, conf.QuotaImages))
+	}
+	return problems
+}
+
+// uploadedSince counts images the task has uploaded after the moment, by the events of the task.
+func uploadedSince(id string, moment time.Time) int {
+	events, _ := queue.ReadEvents(id, 0)
+	var count int = 0
+	for _, e := range events {
+		if (e.Kind == queue.EventImageUploaded) && e.Time.After(moment) {
+			count++
+		}
+	}
+	return count
+}
+
+// quotaMutex makes the quota check and queueing of the task one step, concurrent submits
+// of the same user would pass the check together otherwise.
+var quotaMutex sync.Mutex
+
+// submitWithinQuota queues the task unless the user is over the quota, then the problems are returned.
+func submitWithinQuota(lj ljapi.LJClient, query reuploadQuery, priority int, not_before time.Time) (string, []string, error) {
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	problems := checkQuota(lj.User, len(query.Links))
+	if len(problems) > 0 {
+		return "", problems, nil
+	}
+	id, err := submitTask(lj, query, priority, not_before)
+	return id, nil, err
+}
+
+func registerReuploadQuery(response http.ResponseWriter, request *http.Request) {
+	current, ok := currentSession(request)
+	if !ok {
+		http.Redirect(response, request, "/lj_auth", http.StatusSeeOther)
+		return
+	}
+	err := request.ParseForm()
+	if err != nil {
+		slog.Warn("Failed to parse form", "user", current.LJ.User, "error", err)
+		loadPage(response, "pages/500.html")
+		return
+	}
+	lj_user := current.LJ.User
+	email := current.Email
+	links, problems := validateLinks(request.Form.Get("links"))
+	rule_lines := strings.Split(request.Form.Get("rules"), "\r\n")
+	_, errs := rules.Parse(rule_lines)
+	for _, e := range errs {
+		problems = append(problems, "Rules, " + e.Error())
+	}
+	processing, processing_problems := parseProcessing(request)
+	problems = append(problems, processing_problems...)
+	not_before, err := parseNotBefore(request.Form.Get("not_before"))
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		tasksRefused.Inc("form", "invalid")
+		loadErrorsPage(response, problems)
+		return
+	}
+	if ((lj_user == "") || (email == "") || (len(links) == 0) || (len(rule_lines) == 0)) {
 		loadPage(response, "pages/400.html")
 		return
 	}
 	query := reuploadQuery{
-		LJ: ljapi.LJClient{User: lj_user, PassHash: lj_passhash},
 		Email: email,
 		Links: links,
-		Rules: rules,
+		Rules: rule_lines,
+		Comments: request.Form.Get("comments") != "",
+		Userpics: request.Form.Get("userpics") != "",
+		Processing: processing,
+		Rollback: request.Form.Get("rollback") != "",
 	}
-	js_bytes, err := json.Marshal(query)
+	id, quota_problems, err := submitWithinQuota(current.LJ, query, 0, not_before)
+	if len(quota_problems) > 0 {
+		tasksRefused.Inc("form", "quota")
+		loadErrorsPage(response, quota_problems)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to queue task", "user", lj_user, "error", err)
+		loadPage(response, "pages/500.html")
+		return
+	}
+	tasksSubmitted.Inc("form")
+	content, err := ioutil.ReadFile("pages/reupload.html")
+	if err != nil {
+		loadPage(response, "pages/500.html")
+		return
+	}
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(response, string(content), id, id)
+}
+
+// Sample previews make the site fetch images of a post, so a user gets one preview per interval.
+const PREVIEW_INTERVAL = 10 * time.Second
+
+var previews = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: make(map[string]time.Time)}
+
+func allowPreview(user string) bool {
+	previews.Lock()
+	defer previews.Unlock()
+	for key, value := range previews.last {
+		if time.Since(value) > PREVIEW_INTERVAL {
+			delete(previews.last, key)
+		}
+	}
+	if _, ok := previews.last[user]; ok {
+		return false
+	}
+	previews.last[user] = time.Now()
+	return true
+}
+
+// checkSample tells why the sample post can't be previewed, only posts of the user's own journal can.
+func checkSample(user, sample string) error {
+	parsed, err := ljapi.ParsePostURL(sample)
+	if err != nil {
+		return err
+	}
+	if !sameUser(parsed.Journal, user) {
+		return errors.New("only posts of your own journal can be previewed")
+	}
+	if !allowPreview(user) {
+		return errors.New("too many previews, try again in a few seconds")
+	}
+	return nil
+}
+
+func validateRules(response http.ResponseWriter, request *http.Request) {
+	type diagnostic struct {
+		Line	int		`json:"line"`
+		Message	string	`json:"message"`
+	}
+	type preview struct {
+		URL		string	`json:"url"`
+		Action	string	`json:"action"`
+		Line	int		`json:"line"`
+		Rule	string	`json:"rule"`
+		Class	string	`json:"class,omitempty"`
+		Format	string	`json:"format,omitempty"`
+		Width	int		`json:"width,omitempty"`
+		Height	int		`json:"height,omitempty"`
+		Error	string	`json:"error,omitempty"`
+	}
+	type validation struct {
+		Errors	[]diagnostic	`json:"errors"`
+		Images	[]preview		`json:"images"`
+		Sample	string			`json:"sample_error,omitempty"`
+	}
+	const MAX_PREVIEW_IMAGES = 50
+
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err := request.ParseForm()
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	result := validation{Errors: []diagnostic{}, Images: []preview{}}
+	set, errs := rules.Parse(strings.Split(request.Form.Get("rules"), "\n"))
+	for _, e := range errs {
+		result.Errors = append(result.Errors, diagnostic{Line: e.Line, Message: e.Msg})
+	}
+
+	sample := strings.TrimSpace(request.Form.Get("sample"))
+	current, ok := currentSession(request)
+	if (sample != "") && (len(errs) == 0) && ok {
+		err = checkSample(current.LJ.User, sample)
+		if err != nil {
+			result.Sample = err.Error()
+			sample = ""
+		}
+	} else if (sample != "") && (len(errs) == 0) {
+		result.Sample = "Session has expired, log in again"
+		sample = ""
+	}
+	if (sample != "") && (len(errs) == 0) {
+		post, err := current.LJ.GetPost(sample)
+		if err != nil {
+			result.Sample = err.Error()
+		}
+		for index, image_url := range images.Extract(post.Content, sample) {
+			if index >= MAX_PREVIEW_IMAGES {
+				break
+			}
+			img := images.Image{URL: image_url}
+			entry := preview{URL: image_url}
+			if err := img.GetInfo(); err != nil {
+				entry.Error = err.Error()
+			}
+			img.Examine(set)
+			entry.Class = img.Class
+			entry.Format = img.Format
+			entry.Width = img.Width
+			entry.Height = img.Height
+			action, rule := set.Check(img.Attributes())
+			entry.Action = action.String()
+			if rule != nil {
+				entry.Line = rule.Line
+				entry.Rule = rule.Text
+			} else {
+				entry.Rule = "DEFAULT " + action.String()
+			}
+			result.Images = append(result.Images, entry)
+		}
+	}
+
+	js_bytes, err := json.Marshal(result)
+	if err != nil {
+		slog.Error("Failed to encode validation result", "error", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	response.Write(js_bytes)
+}
+
+var stateNames = map[queue.State]string{
+	queue.Queued: "В очереди",
+	queue.Running: "Выполняется",
+	queue.Paused: "Приостановлена",
+	queue.Done: "Завершена",
+	queue.Failed: "Не выполнена",
+	queue.Cancelled: "Отменена",
+}
+
+func describeStatus(status queue.Status) string {
+	var result string = stateNames[status.State]
+	if status.Error != "" {
+		result = result + " : " + status.Error
+	}
+	return html.EscapeString(result)
+}
+
+func loadTaskPage(response http.ResponseWriter, id string) {
+	if !queue.ValidID(id) {
+		loadPage(response, "pages/404.html")
+		return
+	}
+	status, err := queue.LoadStatus(id)
+	if err != nil {
+		loadPage(response, "pages/404.html")
+		return
+	}
+	content, err := ioutil.ReadFile("pages/task.html")
+	if err != nil {
+		loadPage(response, "pages/500.html")
+		return
+	}
+
+	var details string = fmt.Sprintf("Добавлена: %s<br>\nПостов обработано: <span id = \"posts_done\">%d</span> из %d<br>\n", status.Submitted.Format("2006-01-02 15:04:05"), status.PostsDone, status.Posts)
+	if position := queue.Position(id); (status.State == queue.Queued) && (position >= 0) {
+		details = details + fmt.Sprintf("Задач перед вами в очереди: %d<br>\n", position)
+	}
+	if status.Priority != 0 {
+		details = details + fmt.Sprintf("Приоритет: %d<br>\n", status.Priority)
+	}
+	if !status.NotBefore.IsZero() {
+		details = details + fmt.Sprintf("Начать не раньше: %s<br>\n", status.NotBefore.Format("2006-01-02 15:04"))
+	}
+	if status.State == queue.Queued {
+		if start, err := queue.ExpectedStart(id); err == nil {
+			details = details + fmt.Sprintf("Ожидаемое начало: %s<br>\n", start.Format("2006-01-02 15:04"))
+		}
+	}
+	details = details + fmt.Sprintf("Текущий пост: <span id = \"current_post\">%s</span><br>\n", html.EscapeString(status.CurrentPost))
+	details = details + fmt.Sprintf("Картинок перезалито: <span id = \"images_done\">%d</span>, пропущено: <span id = \"images_skipped\">%d</span>, с ошибками: <span id = \"images_failed\">%d</span>", status.ImagesDone, status.ImagesSkipped, status.ImagesFailed)
+
+	// the log is made of events published so far, the page then follows the stream of new ones
+	var report string = ""
+	var last int = 0
+	events, err := queue.ReadEvents(id, 0)
+	if err == nil {
+		for _, e := range events {
+			report = report + e.String()
+			last = e.Seq
+		}
+	} else if content, err := ioutil.ReadFile(queue.ReportLog(id)); err == nil {
+		report = string(content)
+	}
+	var stream string = ""
+	if (status.State == queue.Queued) || (status.State == queue.Running) || (status.State == queue.Paused) {
+		stream = fmt.Sprintf("/task/%s/events?after=%d", id, last)
+	}
+	var controls string = ""
+	button := func(action, title string) string {
+		return fmt.Sprintf("<form action = \"/task/%s/control\" method = \"POST\" style = \"display: inline\"><input type = \"hidden\" name = \"action\" value = \"%s\"><input type = \"submit\" value = \"%s\"></form>\n", id, action, title)
+	}
+	switch control := queue.GetControl(id); {
+		case control == queue.ControlCancel: controls = "Задача будет отменена после текущей картинки."
+		case status.State == queue.Queued: controls = button("cancel", "Отменить")
+		case (status.State == queue.Running) && (control == queue.ControlPause): controls = "Задача будет приостановлена после текущей картинки.<br>\n" + button("resume", "Продолжить") + button("cancel", "Отменить")
+		case status.State == queue.Running: controls = button("pause", "Приостановить") + button("cancel", "Отменить")
+		case status.State == queue.Paused: controls = button("resume", "Продолжить") + button("cancel", "Отменить")
+	}
+	var download string = ""
+	if _, err := os.Stat(queue.ReportArchive(id)); err == nil {
+		download = fmt.Sprintf(`<a href = "/task/%s/report">Скачать отчёт</a>`, id)
+	}
+
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(response, string(content), id, describeStatus(status), details, controls, stream, html.EscapeString(report), download)
+}
+
+// streamTaskEvents sends progress events of the task as Server-Sent Events until it finishes.
+func streamTaskEvents(response http.ResponseWriter, request *http.Request, id string) {
+	if !queue.ValidID(id) {
+		loadPage(response, "pages/404.html")
+		return
+	}
+	if _, err := queue.LoadStatus(id); err != nil {
+		loadPage(response, "pages/404.html")
+		return
+	}
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		loadPage(response, "pages/500.html")
+		return
+	}
+	after, _ := strconv.Atoi(request.URL.Query().Get("after"))
+	if last := request.Header.Get("Last-Event-ID"); last != "" {
+		after, _ = strconv.Atoi(last)
+	}
+
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	reader := queue.NewEventReader(id)
+	for {
+		events, _ := reader.Read(after)
+		for _, e := range events {
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(response, "id: %d\ndata: %s\n\n", e.Seq, data)
+			after = e.Seq
+		}
+		flusher.Flush()
+		status, err := queue.LoadStatus(id)
+		if (err != nil) || (status.State == queue.Done) || (status.State == queue.Failed) || (status.State == queue.Cancelled) {
+			fmt.Fprint(response, "event: end\ndata: \n\n")
+			flusher.Flush()
+			return
+		}
+		select {
+			case <-request.Context().Done(): return
+			case <-time.After(time.Second):
+		}
+	}
+}
+
+// controlTask applies cancel, pause or resume requested through the site or the API.
+func controlTask(id, action string) error {
+	switch action {
+		case "cancel": return queue.Cancel(id)
+		case "pause": return queue.Pause(id)
+		case "resume": return queue.Resume(id)
+	}
+	return errors.New(action + " : unknown action")
+}
+
+// Task id is unguessable, so whoever knows the status page link may control the task.
+func registerTaskControl(response http.ResponseWriter, request *http.Request, id string) {
+	if !queue.ValidID(id) || (request.Method != "POST") {
+		loadPage(response, "pages/404.html")
+		return
+	}
+	if _, err := queue.LoadStatus(id); err != nil {
+		loadPage(response, "pages/404.html")
+		return
+	}
+	err := request.ParseForm()
+	if err != nil {
+		loadPage(response, "pages/500.html")
+		return
+	}
+	err = controlTask(id, request.Form.Get("action"))
+	if err != nil {
+		slog.Warn("Failed to control task", "task", id, "action", request.Form.Get("action"), "error", err)
+	}
+	http.Redirect(response, request, "/task/" + id, http.StatusSeeOther)
+}
+
+func loadTaskReport(response http.ResponseWriter, id string) {
+	if !queue.ValidID(id) {
+		loadPage(response, "pages/404.html")
+		return
+	}
+	f, err := os.Open(queue.ReportArchive(id))
+	if err != nil {
+		loadPage(response, "pages/404.html")
+		return
+	}
+	defer f.Close()
+	response.Header().Set("Content-Type", "application/gzip")
+	response.Header().Set("Content-Disposition", "attachment; filename=\"report-" + id + ".tar.gz\"")
+	io.Copy(response, f)
+}
+
+func loadHistoryPage(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		loadPage(response, "pages/history.html")
+		return
+	}
+	err := request.ParseForm()
+	if err != nil {
+		loadPage(response, "pages/500.html")
+		return
+	}
+	user, valid := canonicalUser(request.Form.Get("user"))
+	if !valid {
+		loadPage(response, "pages/400.html")
+		return
+	}
+	buf := md5.Sum([]byte(request.Form.Get("password")))
+	lj := ljapi.LJClient{User: user, PassHash: hex.EncodeToString(buf[:])}
+	ok, err := lj.TryLogIn()
+	if err != nil {
+		slog.Error("Failed to log in to LJ", "user", user, "error", err)
+		loadPage(response, "pages/500.html")
+		return
+	}
+	if !ok {
+		slog.Warn("Wrong LJ password", "user", user)
+		loadPage(response, "pages/403.html")
+		return
+	}
+	content, err := ioutil.ReadFile("pages/history_list.html")
 	if err != nil {
-		log.Print(err)
 		loadPage(response, "pages/500.html")
 		return
 	}
-	fmt.Fprint(f, string(js_bytes))
-	f.Close()
-	os.Chown(taskfile, conf.UserID, conf.GroupID)
-	os.Chmod(taskfile, 0660)
-	loadPage(response, "pages/reupload.html")
-	log.Printf("Registered a reupload query. Task file: %s", taskfile)
+	statuses, err := queue.Statuses()
+	if err != nil {
+		slog.Error("Failed to load statuses", "user", user, "error", err)
+		loadPage(response, "pages/500.html")
+		return
+	}
+	var list string = ""
+	for _, status := range statuses {
+		if !sameUser(status.User, user) {
+			continue
+		}
+		list = list + fmt.Sprintf("<a href = \"/task/%s\">%s</a> - %s<br>\n", status.ID, status.Submitted.Format("2006-01-02 15:04:05"), describeStatus(status))
+	}
+	if list == "" {
+		list = "Задач пока не было."
+	}
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(response, string(content), html.EscapeString(user), list)
+}
+
+// JSON API mirroring the web form. Clients get a token from /api/v1/auth and pass it
+// in the Authorization header as "Bearer <token>".
+
+const API_TOKEN_LIFETIME = 24 * time.Hour
+
+// Tokens of the API and the admin cookie are sealed with the same key, the purpose keeps
+// one from being accepted as the other.
+const (
+	TOKEN_API = "api"
+	TOKEN_ADMIN = "admin"
+)
+
+type apiToken struct {
+	User	string	`json:"user"`
+	PassHash	string	`json:"passhash"`
+	Expires	int64	`json:"expires"`
+	Purpose	string	`json:"purpose"`
+}
+
+type apiError struct {
+	Error		string		`json:"error"`
+	Problems	[]string	`json:"problems,omitempty"`
+}
+
+type apiTask struct {
+	queue.Status
+	Control		queue.Control	`json:"control,omitempty"`
+	Position	int		`json:"position"`
+	ExpectedStart	*time.Time	`json:"expected_start,omitempty"`
+	Report		string	`json:"report,omitempty"`
+}
+
+func writeJSON(response http.ResponseWriter, code int, value interface{}) {
+	js_bytes, err := json.Marshal(value)
+	if err != nil {
+		slog.Error("Failed to encode response", "error", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	response.WriteHeader(code)
+	response.Write(js_bytes)
+}
+
+func writeAPIError(response http.ResponseWriter, code int, msg string, problems []string) {
+	writeJSON(response, code, apiError{Error: msg, Problems: problems})
+}
+
+// apiAuthenticate checks the bearer token, which is LJ credentials sealed with the task key.
+func apiAuthenticate(request *http.Request) (ljapi.LJClient, bool) {
+	header := request.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ljapi.LJClient{}, false
+	}
+	content, err := secret.Open(taskKey, strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		return ljapi.LJClient{}, false
+	}
+	var token apiToken
+	err = json.Unmarshal(content, &token)
+	if (err != nil) || (time.Now().Unix() > token.Expires) || (token.Purpose != TOKEN_API) {
+		return ljapi.LJClient{}, false
+	}
+	return ljapi.LJClient{User: token.User, PassHash: token.PassHash}, true
+}
+
+func apiAuth(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		writeAPIError(response, http.StatusMethodNotAllowed, "Method not allowed", nil)
+		return
+	}
+	var credentials struct {
+		User		string	`json:"user"`
+		Password	string	`json:"password"`
+	}
+	err := json.NewDecoder(request.Body).Decode(&credentials)
+	if (err != nil) || (credentials.User == "") || (credentials.Password == "") {
+		writeAPIError(response, http.StatusBadRequest, "user and password are required", nil)
+		return
+	}
+	user, valid := canonicalUser(credentials.User)
+	if !valid {
+		writeAPIError(response, http.StatusBadRequest, "Invalid user name", nil)
+		return
+	}
+	buf := md5.Sum([]byte(credentials.Password))
+	lj := ljapi.LJClient{User: user, PassHash: hex.EncodeToString(buf[:])}
+	ok, err := lj.TryLogIn()
+	if err != nil {
+		slog.Error("Failed to log in to LJ", "user", user, "error", err)
+		writeAPIError(response, http.StatusBadGateway, "Failed to reach LiveJournal", nil)
+		return
+	}
+	if !ok {
+		slog.Warn("Wrong LJ password", "user", user)
+		writeAPIError(response, http.StatusForbidden, "Wrong user or password", nil)
+		return
+	}
+	var expires time.Time = time.Now().Add(API_TOKEN_LIFETIME)
+	content, err := json.Marshal(apiToken{User: lj.User, PassHash: lj.PassHash, Expires: expires.Unix(), Purpose: TOKEN_API})
+	if err != nil {
+		slog.Error("Failed to encode API token", "user", lj.User, "error", err)
+		writeAPIError(response, http.StatusInternalServerError, "Internal error", nil)
+		return
+	}
+	token, err := secret.Seal(taskKey, content)
+	if err != nil {
+		slog.Error("Failed to seal API token", "user", lj.User, "error", err)
+		writeAPIError(response, http.StatusInternalServerError, "Internal error", nil)
+		return
+	}
+	writeJSON(response, http.StatusOK, map[string]interface{}{"token": token, "expires": expires})
+}
+
+func apiSubmitTask(response http.ResponseWriter, request *http.Request, lj ljapi.LJClient) {
+	var query struct {
+		reuploadQuery
+		Priority	int			`json:"priority"`
+		NotBefore	time.Time	`json:"not_before"`
+	}
+	err := json.NewDecoder(request.Body).Decode(&query)
+	if err != nil {
+		writeAPIError(response, http.StatusBadRequest, "Invalid JSON : " + err.Error(), nil)
+		return
+	}
+	links, problems := validateLinks(strings.Join(query.Links, "\n"))
+	_, errs := rules.Parse(query.Rules)
+	for _, e := range errs {
+		problems = append(problems, "Rules, " + e.Error())
+	}
+	if query.Processing.TranscodeFormat == "" {
+		query.Processing.TranscodeFormat = "png"
+	}
+	if (query.Processing.TranscodeFormat != "png") && (query.Processing.TranscodeFormat != "jpeg") {
+		problems = append(problems, query.Processing.TranscodeFormat + " : unsupported transcode format")
+	}
+	if (query.Processing.MaxDimension < 0) || (query.Processing.MaxSize < 0) {
+		problems = append(problems, "Processing limits can't be negative")
+	}
+	if (query.Email == "") || (len(links) == 0) || (len(query.Rules) == 0) {
+		problems = append(problems, "email, links and rules are required")
+	}
+	if (query.Priority != 0) && !isAdmin(lj.User) {
+		problems = append(problems, "Only admins can set priority")
+	}
+	if len(problems) > 0 {
+		tasksRefused.Inc("api", "invalid")
+		writeAPIError(response, http.StatusBadRequest, "Invalid task", problems)
+		return
+	}
+	query.Sealed = ""
+	query.Links = links
+	id, problems, err := submitWithinQuota(lj, query.reuploadQuery, query.Priority, query.NotBefore)
+	if len(problems) > 0 {
+		tasksRefused.Inc("api", "quota")
+		writeAPIError(response, http.StatusTooManyRequests, "Quota exceeded", problems)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to queue task", "user", lj.User, "error", err)
+		writeAPIError(response, http.StatusInternalServerError, "Internal error", nil)
+		return
+	}
+	tasksSubmitted.Inc("api")
+	status, _ := queue.LoadStatus(id)
+	writeJSON(response, http.StatusCreated, describeAPITask(status))
+}
+
+func describeAPITask(status queue.Status) apiTask {
+	result := apiTask{Status: status, Control: queue.GetControl(status.ID), Position: -1}
+	if status.State == queue.Queued {
+		result.Position = queue.Position(status.ID)
+		if start, err := queue.ExpectedStart(status.ID); err == nil {
+			result.ExpectedStart = &start
+		}
+	}
+	if _, err := os.Stat(queue.ReportArchive(status.ID)); err == nil {
+		result.Report = "/api/v1/tasks/" + status.ID + "/report"
+	}
+	return result
+}
+
+func apiListTasks(response http.ResponseWriter, lj ljapi.LJClient) {
+	statuses, err := queue.Statuses()
+	if err != nil {
+		slog.Error("Failed to load statuses", "user", lj.User, "error", err)
+		writeAPIError(response, http.StatusInternalServerError, "Internal error", nil)
+		return
+	}
+	var result []apiTask = []apiTask{}
+	for _, status := range statuses {
+		if sameUser(status.User, lj.User) {
+			result = append(result, describeAPITask(status))
+		}
+	}
+	writeJSON(response, http.StatusOK, result)
+}
+
+func apiTaskRequest(response http.ResponseWriter, request *http.Request, lj ljapi.LJClient, path string) {
+	parts := strings.Split(path, "/")
+	var id string = parts[0]
+	if !queue.ValidID(id) || (len(parts) > 2) {
+		writeAPIError(response, http.StatusNotFound, "Not found", nil)
+		return
+	}
+	status, err := queue.LoadStatus(id)
+	// other users' tasks are reported as missing too, only admins see them
+	if (err != nil) || (!sameUser(status.User, lj.User) && !isAdmin(lj.User)) {
+		writeAPIError(response, http.StatusNotFound, "Not found", nil)
+		return
+	}
+	if (len(parts) == 2) && ((parts[1] == "pause") || (parts[1] == "resume")) {
+		if request.Method != "POST" {
+			writeAPIError(response, http.StatusMethodNotAllowed, "Method not allowed", nil)
+			return
+		}
+		apiControlTask(response, id, parts[1])
+		return
+	}
+	if (len(parts) == 2) && (parts[1] == "priority") {
+		apiSetPriority(response, request, lj, id)
+		return
+	}
+	if len(parts) == 2 {
+		if (parts[1] != "report") || (request.Method != "GET") {
+			writeAPIError(response, http.StatusNotFound, "Not found", nil)
+			return
+		}
+		if _, err := os.Stat(queue.ReportArchive(id)); err != nil {
+			writeAPIError(response, http.StatusNotFound, "Report is not ready yet", nil)
+			return
+		}
+		loadTaskReport(response, id)
+		return
+	}
+	switch request.Method {
+		case "GET": writeJSON(response, http.StatusOK, describeAPITask(status))
+		case "DELETE": apiControlTask(response, id, "cancel")
+		default: writeAPIError(response, http.StatusMethodNotAllowed, "Method not allowed", nil)
+	}
+}
+
+func apiSetPriority(response http.ResponseWriter, request *http.Request, lj ljapi.LJClient, id string) {
+	if request.Method != "POST" {
+		writeAPIError(response, http.StatusMethodNotAllowed, "Method not allowed", nil)
+		return
+	}
+	if !isAdmin(lj.User) {
+		writeAPIError(response, http.StatusForbidden, "Only admins can set priority", nil)
+		return
+	}
+	var body struct {
+		Priority	int	`json:"priority"`
+	}
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		writeAPIError(response, http.StatusBadRequest, "Invalid JSON : " + err.Error(), nil)
+		return
+	}
+	err = queue.SetPriority(id, body.Priority)
+	if (err == queue.ErrFinished) || (err == queue.ErrNotQueued) {
+		writeAPIError(response, http.StatusConflict, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to set priority", "task", id, "user", lj.User, "error", err)
+		writeAPIError(response, http.StatusInternalServerError, "Internal error", nil)
+		return
+	}
+	status, _ := queue.LoadStatus(id)
+	writeJSON(response, http.StatusOK, describeAPITask(status))
+}
+
+func apiControlTask(response http.ResponseWriter, id, action string) {
+	err := controlTask(id, action)
+	if (err == queue.ErrFinished) || (err == queue.ErrNotRunning) || (err == queue.ErrNotPaused) {
+		writeAPIError(response, http.StatusConflict, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to control task", "task", id, "action", action, "error", err)
+		writeAPIError(response, http.StatusInternalServerError, "Internal error", nil)
+		return
+	}
+	status, _ := queue.LoadStatus(id)
+	writeJSON(response, http.StatusOK, describeAPITask(status))
+}
+
+func apiHandler(response http.ResponseWriter, request *http.Request) {
+	var path string = strings.TrimPrefix(request.URL.Path, "/api/v1/")
+	if path == "auth" {
+		apiAuth(response, request)
+		return
+	}
+	lj, ok := apiAuthenticate(request)
+	if !ok {
+		writeAPIError(response, http.StatusUnauthorized, "Invalid or expired token", nil)
+		return
+	}
+	switch {
+		case (path == "tasks") && (request.Method == "GET"): apiListTasks(response, lj)
+		case (path == "tasks") && (request.Method == "POST"): apiSubmitTask(response, request, lj)
+		case path == "tasks": writeAPIError(response, http.StatusMethodNotAllowed, "Method not allowed", nil)
+		case strings.HasPrefix(path, "tasks/"): apiTaskRequest(response, request, lj, strings.TrimPrefix(path, "tasks/"))
+		default: writeAPIError(response, http.StatusNotFound, "Not found", nil)
+	}
+}
+
+// Admin section. Admins log in with their LJ credentials once, then a sealed cookie proves who they are.
+
+const ADMIN_COOKIE = "ljir_admin"
+const ADMIN_SESSION_LIFETIME = 12 * time.Hour
+const ADMIN_RECENT_TASKS = 100
+
+func adminUser(request *http.Request) (string, bool) {
+	cookie, err := request.Cookie(ADMIN_COOKIE)
+	if err != nil {
+		return "", false
+	}
+	content, err := secret.Open(taskKey, cookie.Value)
+	if err != nil {
+		return "", false
+	}
+	var token apiToken
+	err = json.Unmarshal(content, &token)
+	if (err != nil) || (time.Now().Unix() > token.Expires) || (token.Purpose != TOKEN_ADMIN) || !isAdmin(token.User) {
+		return "", false
+	}
+	return token.User, true
+}
+
+func registerAdminLogin(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		loadPage(response, "pages/admin_login.html")
+		return
+	}
+	err := request.ParseForm()
+	if err != nil {
+		loadPage(response, "pages/500.html")
+		return
+	}
+	user, valid := canonicalUser(request.Form.Get("user"))
+	if !valid || !isAdmin(user) {
+		slog.Warn("Not an admin tried to log in", "user", user)
+		loadPage(response, "pages/403.html")
+		return
+	}
+	buf := md5.Sum([]byte(request.Form.Get("password")))
+	lj := ljapi.LJClient{User: user, PassHash: hex.EncodeToString(buf[:])}
+	ok, err := lj.TryLogIn()
+	if err != nil {
+		slog.Error("Failed to log in to LJ", "user", user, "error", err)
+		loadPage(response, "pages/500.html")
+		return
+	}
+	if !ok {
+		slog.Warn("Wrong LJ password", "user", user)
+		loadPage(response, "pages/403.html")
+		return
+	}
+	var expires time.Time = time.Now().Add(ADMIN_SESSION_LIFETIME)
+	content, err := json.Marshal(apiToken{User: user, Expires: expires.Unix(), Purpose: TOKEN_ADMIN})
+	if err != nil {
+		slog.Error("Failed to encode admin token", "user", user, "error", err)
+		loadPage(response, "pages/500.html")
+		return
+	}
+	sealed, err := secret.Seal(taskKey, content)
+	if err != nil {
+		slog.Error("Failed to seal admin token", "user", user, "error", err)
+		loadPage(response, "pages/500.html")
+		return
+	}
+	http.SetCookie(response, &http.Cookie{
+		Name: ADMIN_COOKIE,
+		Value: sealed,
+		Path: "/admin",
+		Expires: expires,
+		HttpOnly: true,
+		Secure: conf.UseTLS,
+		SameSite: http.SameSiteStrictMode,
+	})
+	slog.Info("Admin logged in", "user", user)
+	http.Redirect(response, request, "/admin", http.StatusSeeOther)
+}
+
+func registerAdminLogout(response http.ResponseWriter, request *http.Request) {
+	http.SetCookie(response, &http.Cookie{Name: ADMIN_COOKIE, Value: "", Path: "/admin", MaxAge: -1})
+	http.Redirect(response, request, "/admin/login", http.StatusSeeOther)
+}
+
+func adminTaskRow(status queue.Status, position int) string {
+	button := func(action, title string) string {
+		return fmt.Sprintf("<form action = \"/admin/task\" method = \"POST\" style = \"display: inline\"><input type = \"hidden\" name = \"id\" value = \"%s\"><input type = \"hidden\" name = \"action\" value = \"%s\"><input type = \"submit\" value = \"%s\"></form>", status.ID, action, title)
+	}
+	var actions string = ""
+	switch status.State {
+		case queue.Queued, queue.Running, queue.Paused: actions = button("cancel", "Отменить")
+		default: actions = button("requeue", "В очередь") + button("delete", "Удалить")
+	}
+	if _, err := os.Stat(queue.ReportArchive(status.ID)); err == nil {
+		actions = actions + fmt.Sprintf(" <a href = \"/admin/report/%s\">Отчёт</a>", status.ID)
+	}
+	var place string = ""
+	if position >= 0 {
+		place = strconv.Itoa(position + 1)
+	}
+	return fmt.Sprintf("<tr><td>%s</td><td><a href = \"/task/%s\">%s</a></td><td>%s</td><td>%s</td><td>%d</td><td>%d/%d</td><td>%d/%d/%d</td><td>%s</td><td>%s</td></tr>\n",
+		place, status.ID, status.ID, html.EscapeString(status.User), status.Submitted.Format("2006-01-02 15:04"), status.Priority,
+		status.PostsDone, status.Posts, status.ImagesDone, status.ImagesSkipped, status.ImagesFailed, describeStatus(status), actions)
+}
+
+func loadAdminPage(response http.ResponseWriter, request *http.Request) {
+	user, ok := adminUser(request)
+	if !ok {
+		http.Redirect(response, request, "/admin/login", http.StatusSeeOther)
+		return
+	}
+	content, err := ioutil.ReadFile("pages/admin.html")
+	if err != nil {
+		loadPage(response, "pages/500.html")
+		return
+	}
+	statuses, err := queue.Statuses()
+	if err != nil {
+		slog.Error("Failed to load statuses", "admin", user, "error", err)
+		loadPage(response, "pages/500.html")
+		return
+	}
+
+	var daemon_info string
+	daemon, err := queue.LoadDaemon()
+	if err != nil {
+		daemon_info = "Реаплоадер ещё не сообщал о себе."
+	} else {
+		daemon_info = fmt.Sprintf("Последний отклик реаплоадера: %s<br>\n", daemon.Updated.Format("2006-01-02 15:04:05"))
+		if daemon.Task != "" {
+			daemon_info = daemon_info + fmt.Sprintf("Выполняется задача <a href = \"/task/%s\">%s</a><br>\n", daemon.Task, daemon.Task)
+		}
+		if daemon.ImgurLocked {
+			daemon_info = daemon_info + fmt.Sprintf("Imgur: лимит исчерпан, сброс через %d с", daemon.ImgurResetTime)
+		} else {
+			daemon_info = daemon_info + fmt.Sprintf("Imgur: осталось загрузок %d, сброс через %d с", daemon.ImgurRemaining, daemon.ImgurResetTime)
+		}
+	}
+	var errors_list string = ""
+	for i := len(daemon.Errors) - 1; i >= 0; i-- {
+		e := daemon.Errors[i]
+		errors_list = errors_list + fmt.Sprintf("[%s] %s : %s\n", e.Time.Format("2006-01-02 15:04:05"), e.Task, e.Message)
+	}
+	if errors_list == "" {
+		errors_list = "Ошибок нет."
+	}
+
+	var positions map[string]int = make(map[string]int)
+	order, _ := queue.Order()
+	for index, id := range order {
+		positions[id] = index
+	}
+	var active, failed, recent string = "", "", ""
+	var recent_count int = 0
+	for _, status := range statuses {
+		position, queued := positions[status.ID]
+		if !queued {
+			position = -1
+		}
+		switch status.State {
+			case queue.Queued, queue.Running, queue.Paused: active = active + adminTaskRow(status, position)
+			case queue.Failed: failed = failed + adminTaskRow(status, -1)
+			default:
+				if recent_count < ADMIN_RECENT_TASKS {
+					recent = recent + adminTaskRow(status, -1)
+					recent_count++
+				}
+		}
+	}
+
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(response, string(content), html.EscapeString(user), daemon_info, html.EscapeString(errors_list), active, failed, recent)
+}
+
+func registerAdminAction(response http.ResponseWriter, request *http.Request) {
+	user, ok := adminUser(request)
+	if !ok || (request.Method != "POST") {
+		loadPage(response, "pages/403.html")
+		return
+	}
+	err := request.ParseForm()
+	if err != nil {
+		loadPage(response, "pages/500.html")
+		return
+	}
+	id := request.Form.Get("id")
+	action := request.Form.Get("action")
+	if !queue.ValidID(id) {
+		loadPage(response, "pages/404.html")
+		return
+	}
+	switch action {
+		case "requeue": err = queue.Requeue(id)
+		case "delete": err = queue.Delete(id)
+		default: err = controlTask(id, action)
+	}
+	if err != nil {
+		slog.Warn("Admin failed to control task", "admin", user, "task", id, "action", action, "error", err)
+		loadErrorsPage(response, []string{id + " : " + err.Error()})
+		return
+	}
+	slog.Info("Admin controlled task", "admin", user, "task", id, "action", action)
+	http.Redirect(response, request, "/admin", http.StatusSeeOther)
+}
+
+func loadAdminReport(response http.ResponseWriter, request *http.Request, id string) {
+	if _, ok := adminUser(request); !ok {
+		loadPage(response, "pages/403.html")
+		return
+	}
+	loadTaskReport(response, id)
 }
 
 func loadFavicon(response http.ResponseWriter) {
@@ -188,7 +1411,7 @@ func loadFavicon(response http.ResponseWriter) {
 
 func handler(response http.ResponseWriter, request *http.Request) {
 	var url string = request.URL.Path
-	log.Printf("Request to %s from %s", url, request.RemoteAddr)
+	slog.Info("Request", "path", url, "remote", request.RemoteAddr)
 	switch url {
 		case "/400": loadPage(response, "pages/400.html")
 		case "/403": loadPage(response, "pages/403.html")
@@ -197,32 +1420,63 @@ func handler(response http.ResponseWriter, request *http.Request) {
 		case "/": loadPage(response, "pages/welcome.html")
 		case "/lj_auth": loadPage(response, "pages/lj_auth.html")
 		case "/rules": loadPage(response, "pages/rules.html")
+		case "/rules/validate": validateRules(response, request)
 		case "/style.css": loadStyleSheet(response)
 		case "/reupload": registerReuploadQuery(response, request)
 		case "/options": loadOptionsPage(response, request)
 		case "/favicon.ico": loadFavicon(response)
-		default: loadPage(response, "pages/404.html")
+		case "/history": loadHistoryPage(response, request)
+		case "/admin": loadAdminPage(response, request)
+		case "/admin/login": registerAdminLogin(response, request)
+		case "/admin/logout": registerAdminLogout(response, request)
+		case "/admin/task": registerAdminAction(response, request)
+		default:
+			if strings.HasPrefix(url, "/api/v1/") {
+				apiHandler(response, request)
+			} else if strings.HasPrefix(url, "/admin/report/") {
+				loadAdminReport(response, request, strings.TrimPrefix(url, "/admin/report/"))
+			} else if strings.HasPrefix(url, "/task/") && strings.HasSuffix(url, "/control") {
+				registerTaskControl(response, request, strings.TrimSuffix(strings.TrimPrefix(url, "/task/"), "/control"))
+			} else if strings.HasPrefix(url, "/task/") && strings.HasSuffix(url, "/events") {
+				streamTaskEvents(response, request, strings.TrimSuffix(strings.TrimPrefix(url, "/task/"), "/events"))
+			} else if strings.HasPrefix(url, "/task/") && strings.HasSuffix(url, "/report") {
+				loadTaskReport(response, strings.TrimSuffix(strings.TrimPrefix(url, "/task/"), "/report"))
+			} else if strings.HasPrefix(url, "/task/") {
+				loadTaskPage(response, strings.TrimPrefix(url, "/task/"))
+			} else {
+				loadPage(response, "pages/404.html")
+			}
 	}
 }
 
 func main() {
-	log.Print("LJIR Online Front-End")
+	slog.Info("LJIR Online Front-End")
 
 	loadConfig("ljir.conf")
 
+	var err error
+	taskKey, err = secret.LoadKey(conf.TaskKey)
+	if err != nil {
+		slog.Error("Failed to load task key", "error", err)
+		os.Exit(1)
+	}
+
 	oldmask := syscall.Umask(0)
 	defer syscall.Umask(oldmask)
 
-	rand.Seed(int64(time.Now().Unix()))
-
-	os.RemoveAll("tasks/")
-	os.Mkdir("tasks/", 0770)
-	os.Chown("tasks/", conf.UserID, conf.GroupID)
+	queue.UserID = conf.UserID
+	queue.GroupID = conf.GroupID
+	queue.SlicePosts = conf.SlicePosts
+	queue.Init()
+	metrics.Serve(conf.MetricsAddress)
+	images.Client = images.PublicClient()
 
 	http.HandleFunc("/", handler)
 	if conf.UseTLS {
-		log.Fatal(http.ListenAndServeTLS(":443", conf.CertFile, conf.KeyFile, nil))
+		err = http.ListenAndServeTLS(":443", conf.CertFile, conf.KeyFile, nil)
 	} else {
-		log.Fatal(http.ListenAndServe(":80", nil))
+		err = http.ListenAndServe(":80", nil)
 	}
+	slog.Error("Server stopped", "error", err)
+	os.Exit(1)
 }
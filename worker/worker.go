@@ -0,0 +1,503 @@
+// Package worker executes reupload tasks, it is shared by the queue daemon and the command-line client.
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"../archive"
+	"../images"
+	"../imgurapi"
+	"../ljapi"
+	"../rules"
+	"../metrics"
+)
+
+// Reporter receives progress of the job. Each call is a single event, the reporter both logs it
+// and shows it to the user, so that the log and the report never disagree.
+type Reporter interface {
+	Log(level slog.Level, image_url, msg string)
+	Post(link string)
+	// PostDone follows every post which was gone through, even if it failed, but not the one
+	// left in the middle when the job stopped.
+	PostDone()
+	ImageDone(image_url, new_image_url string)
+	ImageSkipped(image_url string)
+	ImageFailed(image_url string, err error)
+	RateLimited(until time.Time)
+}
+
+type Task struct {
+	LJ ljapi.LJClient	`json:"-"`
+	Email string			`json:"email"`
+	Links []string		`json:"links"`
+	Rules []string		`json:"rules"`
+	RuleSet *rules.Set	`json:"-"`
+	Comments bool		`json:"comments"`
+	Userpics bool		`json:"userpics"`
+	Processing images.Processing	`json:"processing"`
+	Rollback bool		`json:"rollback"`
+}
+
+// Job is a task being executed, backups are written to Dir.
+// Continue is asked between images and posts, it returns false when the job has to stop.
+type Job struct {
+	Task
+	Dir string
+	Report Reporter
+	Continue func() bool
+	stopped bool
+}
+
+func (j *Job) proceed() bool {
+	if j.stopped {
+		return false
+	}
+	if (j.Continue != nil) && !j.Continue() {
+		j.stopped = true
+		j.Report.Log(slog.LevelInfo, "", "Stopped by the user")
+	}
+	return !j.stopped
+}
+
+// Stopped tells whenever the job was stopped before it finished.
+func (j *Job) Stopped() bool {
+	return j.stopped
+}
+
+var Imgur *imgurapi.ImgurClient
+
+// Archive is where copies of dead images are looked for, nil disables the lookup.
+var Archive archive.Lookup
+
+var (
+	postsEdited = metrics.NewCounter("ljir_posts_edited_total", "Edits of posts and comments on LiveJournal.", "kind", "result")
+	postsVerified = metrics.NewCounter("ljir_posts_verified_total", "Checks of edited posts.", "result")
+	imagesTotal = metrics.NewCounter("ljir_images_total", "Images met in posts, by outcome and reason.", "outcome", "reason")
+	rateLimitWaits = metrics.NewCounter("ljir_imgur_rate_limit_waits_total", "Waits for the Imgur upload limit to reset.")
+	rateLimitSeconds = metrics.NewCounter("ljir_imgur_rate_limit_wait_seconds_total", "Time spent waiting for the Imgur upload limit to reset.")
+)
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// WaitForImgur sleeps until the upload limit of Imgur resets.
+func WaitForImgur() {
+	var wait time.Duration = time.Duration(Imgur.ResetTime + 1) * time.Second
+	slog.Info("Imgur is locked, waiting", "seconds", Imgur.ResetTime)
+	rateLimitWaits.Inc()
+	rateLimitSeconds.Add(wait.Seconds())
+	time.Sleep(wait)
+}
+
+var DyingHosts []string = []string{"photobucket.com", "tinypic.com", "imageshack.us", "radikal.ru", "fotki.yandex.ru"}
+
+func (j *Job) processImage(image_url string) []byte {
+	img := images.Image{URL: image_url}
+	data, err := img.Download()
+	if err != nil {
+		j.Report.Log(slog.LevelWarn, image_url, fmt.Sprintf("%s : failed to download for processing : %s", image_url, err))
+		return nil
+	}
+	processed, err := images.Process(data, j.Processing)
+	if err != nil {
+		j.Report.Log(slog.LevelWarn, image_url, fmt.Sprintf("%s : failed to process : %s", image_url, err))
+		return nil
+	}
+	if bytes.Equal(processed, data) {
+		return nil
+	}
+	j.Report.Log(slog.LevelInfo, image_url, fmt.Sprintf("%s : processed, %d -> %d bytes, %d bytes saved", image_url, len(data), len(processed), len(data) - len(processed)))
+	return processed
+}
+
+func (j *Job) processContent(content, base string) string {
+	var set *rules.Set = j.RuleSet
+	var mapping map[string]string = make(map[string]string)
+
+	for _, ref := range images.Find(content, base) {
+		// images uploaded so far are still put into the content
+		if !j.proceed() {
+			break
+		}
+		var image_url string = ref.URL
+		if ref.Thumbnail != "" {
+			j.Report.Log(slog.LevelInfo, image_url, fmt.Sprintf("%s : full-size image of %s", image_url, ref.Thumbnail))
+		} else if ref.Kind != images.KindSrc {
+			j.Report.Log(slog.LevelInfo, image_url, fmt.Sprintf("%s : found in %s", image_url, ref.Kind))
+		}
+		img := images.Image{URL: image_url}
+		err := img.GetInfo()
+		if err != nil {
+			j.Report.Log(slog.LevelWarn, image_url, fmt.Sprintf("%s : error : %s", image_url, err))
+		}
+		if inspect_err := img.Examine(set); inspect_err != nil {
+			j.Report.Log(slog.LevelWarn, image_url, fmt.Sprintf("%s : failed to inspect : %s", image_url, inspect_err))
+		}
+		if img.Class != "" {
+			j.Report.Log(slog.LevelInfo, image_url, fmt.Sprintf("%s : %s", image_url, img.Class))
+		}
+		if img.Check(set) {
+			var upload_url string = image_url
+			if (Archive != nil) && ((err != nil) || (img.Class == rules.ClassDead)) {
+				if img.Class == "" {
+					img.Classify()
+				}
+				if img.Class == rules.ClassDead {
+					capture, err := Archive.Find(image_url)
+					if err == nil {
+						upload_url = capture.URL
+						j.Report.Log(slog.LevelInfo, image_url, fmt.Sprintf("%s : dead, using archived copy %s from %s", image_url, capture.URL, capture.Timestamp.Format("2006-01-02")))
+					} else {
+						j.Report.Log(slog.LevelWarn, image_url, fmt.Sprintf("%s : dead, no archived copy : %s", image_url, err))
+					}
+				}
+			}
+			if Imgur.Locked {
+				j.Report.RateLimited(time.Now().Add(time.Duration(Imgur.ResetTime + 1) * time.Second))
+				WaitForImgur()
+			}
+			var upload_data []byte = nil
+			if j.Processing.Enabled() {
+				upload_data = j.processImage(upload_url)
+			}
+			Imgur.Locked = false
+			var retried bool = false
+			Retry:
+			var new_image_url string
+			if upload_data != nil {
+				new_image_url, err = Imgur.UploadImageData(upload_data)
+			} else {
+				new_image_url, err = Imgur.UploadImage(upload_url)
+			}
+			if err == nil {
+				mapping[image_url] = new_image_url
+				j.Report.ImageDone(image_url, new_image_url)
+				switch {
+					case upload_url != image_url: imagesTotal.Inc("uploaded", "archive")
+					case upload_data != nil: imagesTotal.Inc("uploaded", "processed")
+					default: imagesTotal.Inc("uploaded", "url")
+				}
+			} else {
+				j.Report.Log(slog.LevelWarn, image_url, fmt.Sprintf("%s : error : %s", image_url, err))
+				if !retried {
+					j.Report.Log(slog.LevelInfo, image_url, "Retrying ONCE")
+					Imgur.Locked = false
+					time.Sleep(5 * time.Second)
+					retried = true
+					goto Retry
+				}
+				j.Report.ImageFailed(image_url, err)
+				if Imgur.Locked {
+					imagesTotal.Inc("failed", "rate_limit")
+				} else {
+					imagesTotal.Inc("failed", "upload")
+				}
+			}
+		} else {
+			j.Report.ImageSkipped(image_url)
+			imagesTotal.Inc("skipped", "rules")
+		}
+	}
+
+	return images.Rewrite(content, base, mapping)
+}
+
+func (j *Job) processPost(link string, post ljapi.LJPost) (ljapi.LJPost, error) {
+	post.Content = j.processContent(post.Content, link)
+	return post, nil
+}
+
+func (j *Job) processComment(link string, comment ljapi.LJComment) (ljapi.LJComment, error) {
+	comment.Body = j.processContent(comment.Body, link)
+	return comment, nil
+}
+
+// backupName names backups of the post as <journal>_<ditemid>, posts of different journals
+// may have the same ditemid.
+func backupName(link string) string {
+	parsed, err := ljapi.ParsePostURL(link)
+	if err != nil {
+		_, filename := path.Split(link)
+		return strings.TrimSuffix(filename, path.Ext(filename))
+	}
+	return fmt.Sprintf("%s_%d", ljapi.CanonicalJournal(parsed.Journal), parsed.DItemID)
+}
+
+// backupPost saves the post before it's edited. A post processed again, after the task was put
+// back to the queue, keeps its first backup, which holds the original content.
+func (j *Job) backupPost(link string, post ljapi.LJPost) error {
+	var filename string = backupName(link)
+	if _, err := os.Stat(j.Dir + filename + ".json"); err == nil {
+		return nil
+	}
+
+	f, err := os.Create(j.Dir + filename + ".txt")
+	defer f.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(f, post.Header, "\n\n\n", post.Content)
+	f.Close()
+
+	post.Content = url.PathEscape(post.Content)
+	post.Header = url.PathEscape(post.Header)
+
+	buf, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+
+	f, err = os.Create(j.Dir + filename + ".json")
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(f, string(buf))
+	return nil
+}
+
+func normalizeContent(content string) string {
+	return strings.TrimSpace(strings.Replace(content, "\r\n", "\n", -1))
+}
+
+// verifyPost fetches the post again to make sure the edit landed and the new images resolve.
+func (j *Job) verifyPost(link string, original, expected ljapi.LJPost) error {
+	actual, err := j.LJ.GetPost(link)
+	if err != nil {
+		return fmt.Errorf("failed to fetch post again : %s", err)
+	}
+	if (normalizeContent(actual.Content) != normalizeContent(expected.Content)) || (actual.Header != expected.Header) {
+		return errors.New("post differs from the expected one")
+	}
+	var before map[string]bool = make(map[string]bool)
+	for _, image_url := range images.Extract(original.Content, link) {
+		before[image_url] = true
+	}
+	for _, image_url := range images.Extract(expected.Content, link) {
+		if before[image_url] {
+			continue
+		}
+		img := images.Image{URL: image_url}
+		if err := img.GetInfo(); err != nil {
+			return fmt.Errorf("%s doesn't resolve : %s", image_url, err)
+		}
+	}
+	return nil
+}
+
+func (j *Job) checkPost(link string, original, expected ljapi.LJPost) {
+	err := j.verifyPost(link, original, expected)
+	if err == nil {
+		postsVerified.Inc("ok")
+		j.Report.Log(slog.LevelInfo, "", fmt.Sprintf("%s : verified", link))
+		return
+	}
+	postsVerified.Inc("mismatched")
+	j.Report.Log(slog.LevelError, "", fmt.Sprintf("%s : mismatched : %s", link, err))
+	if !j.Rollback {
+		return
+	}
+	err = j.LJ.EditPost(original)
+	postsEdited.Inc("rollback", result(err))
+	if err == nil {
+		j.Report.Log(slog.LevelInfo, "", fmt.Sprintf("%s : rolled back to backup", link))
+	} else {
+		j.Report.Log(slog.LevelError, "", fmt.Sprintf("%s : rollback error : %s", link, err))
+	}
+}
+
+func (j *Job) backupComment(link string, comment ljapi.LJComment) error {
+	var filename string = backupName(link) + "-comment-" + comment.ID
+	if _, err := os.Stat(j.Dir + filename + ".json"); err == nil {
+		return nil
+	}
+
+	buf, err := json.Marshal(comment)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(j.Dir + filename + ".json")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprint(f, string(buf))
+	return nil
+}
+
+func (j *Job) executeComments(link string, post ljapi.LJPost, comments []ljapi.LJComment) {
+	for _, comment := range comments {
+		if !j.proceed() {
+			return
+		}
+		if (comment.PostID != post.ID) || (comment.Poster != j.LJ.User) || (comment.State == "D") {
+			continue
+		}
+		j.Report.Log(slog.LevelInfo, "", fmt.Sprintf("Started reuploading for comment %s in post %s", comment.ID, link))
+		err := j.backupComment(link, comment)
+		if err != nil {
+			j.Report.Log(slog.LevelError, "", fmt.Sprintf("Failed to backup comment %s in post %s : %s", comment.ID, link, err))
+			continue
+		}
+		edited, err := j.processComment(link, comment)
+		if err != nil {
+			j.Report.Log(slog.LevelError, "", fmt.Sprintf("Failed to process comment %s in post %s : %s", comment.ID, link, err))
+			continue
+		}
+		if edited.Body == comment.Body {
+			continue
+		}
+		err = j.LJ.EditComment(post, edited)
+		postsEdited.Inc("comment", result(err))
+		if err == nil {
+			j.Report.Log(slog.LevelInfo, "", fmt.Sprintf("%s comment %s : done", link, comment.ID))
+		} else {
+			j.Report.Log(slog.LevelError, "", fmt.Sprintf("%s comment %s : error : %s", link, comment.ID, err))
+		}
+	}
+}
+
+func isDyingHost(domain string) bool {
+	for _, host := range DyingHosts {
+		if (domain == host) || strings.HasSuffix(domain, "." + host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *Job) backupUserpic(index int, pic ljapi.LJUserpic) error {
+	resp, err := http.Get(pic.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Unknown error : " + resp.Status)
+	}
+
+	var filename string = strconv.Itoa(index) + "-" + url.PathEscape(pic.Keyword) + path.Ext(pic.URL)
+	f, err := os.Create(j.Dir + "userpics/" + filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, resp.Body)
+	return err
+}
+
+func (j *Job) executeUserpics() {
+	j.Report.Log(slog.LevelInfo, "", "Started checking userpics")
+	pics, err := j.LJ.GetUserpics()
+	if err != nil {
+		j.Report.Log(slog.LevelError, "", fmt.Sprintf("Failed to get userpics : %s", err))
+		return
+	}
+	os.Mkdir(j.Dir + "userpics/", 0770)
+	for index, pic := range pics {
+		if !j.proceed() {
+			return
+		}
+		// every userpic is backed up and reported, reupload rules of the task are for images in posts
+		img := images.Image{URL: pic.URL}
+		err := img.GetInfo()
+		if err != nil {
+			j.Report.Log(slog.LevelWarn, pic.URL, fmt.Sprintf("Userpic %s (%s) : broken : %s", pic.Keyword, pic.URL, err))
+			continue
+		}
+		err = j.backupUserpic(index, pic)
+		if err != nil {
+			j.Report.Log(slog.LevelError, pic.URL, fmt.Sprintf("Userpic %s (%s) : backup error : %s", pic.Keyword, pic.URL, err))
+			continue
+		}
+		var class string = img.Classify()
+		if isDyingHost(img.Domain) {
+			j.Report.Log(slog.LevelWarn, pic.URL, fmt.Sprintf("Userpic %s (%s) : hosted on dying host %s", pic.Keyword, pic.URL, img.Domain))
+		} else if class != rules.ClassOK {
+			j.Report.Log(slog.LevelWarn, pic.URL, fmt.Sprintf("Userpic %s (%s) : %s", pic.Keyword, pic.URL, class))
+		} else {
+			j.Report.Log(slog.LevelInfo, pic.URL, fmt.Sprintf("Userpic %s (%s) : ok", pic.Keyword, pic.URL))
+		}
+	}
+}
+
+// executePost reuploads images of the post and of comments to it.
+func (j *Job) executePost(link string, comments []ljapi.LJComment) {
+	post, err := j.LJ.GetPost(link)
+	if err != nil {
+		j.Report.Log(slog.LevelError, "", fmt.Sprintf("Failed to get post %s : %s", link, err))
+		return
+	}
+	err = j.backupPost(link, post)
+	if err != nil {
+		j.Report.Log(slog.LevelError, "", fmt.Sprintf("Failed to backup post %s : %s", link, err))
+		return
+	}
+	original := post
+	post, err = j.processPost(link, post)
+	if err != nil {
+		j.Report.Log(slog.LevelError, "", fmt.Sprintf("Failed to process post %s : %s", link, err))
+		return
+	}
+	err = j.LJ.EditPost(post)
+	postsEdited.Inc("post", result(err))
+	if err == nil {
+		j.Report.Log(slog.LevelInfo, "", fmt.Sprintf("%s : done", link))
+		j.checkPost(link, original, post)
+	} else {
+		j.Report.Log(slog.LevelError, "", fmt.Sprintf("%s : error : %s", link, err))
+	}
+	// exported comments are those of the own journal, in others the same jitemid is another post
+	if ljapi.CanonicalJournal(post.Journal) == ljapi.CanonicalJournal(j.LJ.User) {
+		j.executeComments(link, post, comments)
+	} else if j.Comments {
+		j.Report.Log(slog.LevelInfo, "", fmt.Sprintf("%s : comments are processed only in the own journal, skipped", link))
+	}
+}
+
+// Run executes the task: posts are backed up, their images reuploaded and posts edited.
+func (j *Job) Run() {
+	// a task cancelled while it waited between slices gets no further
+	if !j.proceed() {
+		return
+	}
+	j.Report.Log(slog.LevelInfo, "", fmt.Sprintf("Started executing task for %s", j.LJ.User))
+	var comments []ljapi.LJComment
+	if j.Comments {
+		var err error
+		comments, err = j.LJ.GetComments()
+		if err != nil {
+			j.Report.Log(slog.LevelError, "", fmt.Sprintf("Failed to export comments : %s", err))
+		}
+	}
+	for _, link := range j.Links {
+		if !j.proceed() {
+			return
+		}
+		j.Report.Post(link)
+		j.executePost(link, comments)
+		// a post left in the middle is processed again when the task goes on
+		if j.stopped {
+			return
+		}
+		j.Report.PostDone()
+	}
+	if j.Userpics && j.proceed() {
+		j.executeUserpics()
+	}
+}
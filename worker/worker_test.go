@@ -0,0 +1,154 @@
+package worker
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"../archive"
+	"../imgurapi"
+	"../ljapi"
+	"../rules"
+)
+
+// fakeNetwork answers every request of the test: images of dead.example are gone, those of
+// archive.example are there, and Imgur takes any upload.
+type fakeNetwork struct {
+	uploads []string
+}
+
+func respond(request *http.Request, code int, content_type, body string) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Status: http.StatusText(code),
+		Header: http.Header{"Content-Type": []string{content_type}},
+		Body: ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request: request,
+	}
+}
+
+func (n *fakeNetwork) RoundTrip(request *http.Request) (*http.Response, error) {
+	switch request.URL.Host {
+		case "dead.example":
+			return respond(request, http.StatusNotFound, "text/html", "gone"), nil
+		case "imgur-apiv3.p.mashape.com":
+			request.ParseMultipartForm(1024 * 1024)
+			n.uploads = append(n.uploads, request.FormValue("image"))
+			return respond(request, http.StatusOK, "application/json", `{"success": true, "data": {"link": "https://i.imgur.com/new.png"}}`), nil
+	}
+	return respond(request, http.StatusOK, "image/png", "png"), nil
+}
+
+type fakeReporter struct {
+	done map[string]string
+	failed []string
+}
+
+func (r *fakeReporter) Log(level slog.Level, image_url, msg string) {}
+func (r *fakeReporter) Post(link string) {}
+func (r *fakeReporter) PostDone() {}
+func (r *fakeReporter) ImageDone(image_url, new_image_url string) { r.done[image_url] = new_image_url }
+func (r *fakeReporter) ImageSkipped(image_url string) {}
+func (r *fakeReporter) ImageFailed(image_url string, err error) { r.failed = append(r.failed, image_url) }
+func (r *fakeReporter) RateLimited(until time.Time) {}
+
+func TestDeadImageUploadedFromArchive(t *testing.T) {
+	const DEAD = "http://dead.example/a.png"
+	const ARCHIVED = "http://archive.example/web/20100101000000id_/http://dead.example/a.png"
+	network := &fakeNetwork{}
+	saved := http.DefaultTransport
+	http.DefaultTransport = network
+	defer func() { http.DefaultTransport = saved }()
+	Imgur = &imgurapi.ImgurClient{}
+	Archive = archive.Fake{DEAD: {URL: ARCHIVED, Timestamp: time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	defer func() { Archive = nil }()
+
+	set, errs := rules.Parse([]string{"REUPLOAD class=dead"})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	report := &fakeReporter{done: make(map[string]string)}
+	job := Job{Task: Task{RuleSet: set}, Report: report}
+	content := job.processContent(`<img src="` + DEAD + `">`, "https://user.livejournal.com/256.html")
+
+	if (len(network.uploads) != 1) || (network.uploads[0] != ARCHIVED) {
+		t.Fatalf("expected the archived copy to be uploaded, got %q", network.uploads)
+	}
+	if report.done[DEAD] != "https://i.imgur.com/new.png" {
+		t.Fatalf("expected the dead image to be reported as reuploaded, got %v, failed %v", report.done, report.failed)
+	}
+	if !strings.Contains(content, "https://i.imgur.com/new.png") || strings.Contains(content, DEAD) {
+		t.Fatalf("expected the dead image to be replaced, got %s", content)
+	}
+}
+
+func TestDeadImageWithoutCapture(t *testing.T) {
+	network := &fakeNetwork{}
+	saved := http.DefaultTransport
+	http.DefaultTransport = network
+	defer func() { http.DefaultTransport = saved }()
+	Imgur = &imgurapi.ImgurClient{}
+	Archive = archive.Fake{}
+	defer func() { Archive = nil }()
+
+	set, _ := rules.Parse([]string{"REUPLOAD class=dead"})
+	report := &fakeReporter{done: make(map[string]string)}
+	job := Job{Task: Task{RuleSet: set}, Report: report}
+	job.processContent(`<img src="http://dead.example/b.png">`, "https://user.livejournal.com/256.html")
+
+	if (len(network.uploads) == 0) || (network.uploads[0] != "http://dead.example/b.png") {
+		t.Fatalf("expected the original link to be tried without a capture, got %q", network.uploads)
+	}
+}
+
+func TestBackupKeepsOriginalPost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	job := Job{Dir: dir + "/"}
+	link := "https://user.livejournal.com/256.html"
+	if err := job.backupPost(link, ljapi.LJPost{Content: "original"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.backupPost(link, ljapi.LJPost{Content: "rewritten"}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(dir + "/user_256.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "original") {
+		t.Errorf("backup was overwritten : %q", content)
+	}
+}
+
+func TestBackupNamedByJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	job := Job{Dir: dir + "/"}
+	var posts map[string]string = map[string]string{
+		"https://user.livejournal.com/256.html": "user_256.txt",
+		"https://some-community.livejournal.com/256.html": "some_community_256.txt",
+		"https://users.livejournal.com/_other_/256.html": "_other__256.txt",
+	}
+	for link, filename := range posts {
+		if err := job.backupPost(link, ljapi.LJPost{Content: link}); err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(dir + "/" + filename)
+		if err != nil {
+			t.Errorf("%s : %s", link, err)
+		} else if string(content) != "\n\n\n" + link {
+			t.Errorf("%s : backup holds %q", link, content)
+		}
+	}
+}